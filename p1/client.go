@@ -2,45 +2,129 @@
 Author: Haniel Martino
 
 Usage:
-$ go run client.go [local UDP ip:port] [aserver UDP ip:port] [secret]
+$ go run client.go [flags] [local UDP ip:port] [aserver UDP ip:port] [secret]
 */
 
 package main
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/md5"
+	crand "crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math/rand"
 	"net"
 	"os"
 	"strconv"
+	"time"
 )
 
 /////////// Msgs used by both auth and fortune servers:
 
+// Envelope version spoken by this client
+const envelopeVersion = 1
+
+// Envelope around every message to and from the servers.
+type Envelope struct {
+	Type      string          // one of the msg* types below
+	Version   int             // envelope version
+	RequestID uint64          // chosen by the client, echoed in the reply
+	Payload   json.RawMessage // message of the given type
+}
+
+// Envelope message types
+const (
+	msgError       = "error"        // ErrMessage
+	msgNonceReq    = "nonce-req"    // NonceReqMessage
+	msgNonce       = "nonce"        // NonceMessage
+	msgHash        = "hash"         // HashMessage
+	msgFortuneInfo = "fortune-info" // FortuneInfoMessage
+	msgFortuneReq  = "fortune-req"  // FortuneReqMessage
+	msgFortune     = "fortune"      // FortuneMessage
+	msgSealed      = "sealed"       // SealedMessage
+	msgCookie      = "cookie"       // CookieMessage
+)
+
+// Payload of a "sealed" envelope: another envelope with the same request id,
+// encrypted and authenticated with AES-256-GCM under the session key.
+type SealedMessage struct {
+	Nonce      []byte // random, one per message
+	Ciphertext []byte
+}
+
 // An error message from the server.
 type ErrMessage struct {
 	Error string
 }
 
+// Errors the servers send in ErrMessage
+const (
+	errUnknownAddress  = "unknown remote client address"
+	errUnexpectedHash  = "unexpected hash value"
+	errExpiredNonce    = "expired nonce"
+	errUnknownClient   = "unknown client id"
+	errUnsupportedAuth = "unsupported auth protocol version"
+	errNoFserver       = "no fortune server available"
+	errExpiredFortune  = "expired fortune nonce"
+	errUnexpectedNonce = "incorrect fortune nonce"
+	errUnknownCategory = "unknown fortune category"
+	errNoEncryption    = "encryption needs auth protocol version 2 and the envelope"
+	errEncryption      = "encryption required"
+	errTicketEncrypt   = "encryption is not available with tickets"
+	errBadTicket       = "invalid fortune ticket"
+	errExpiredTicket   = "expired fortune ticket"
+	errLockedOut       = "too many failed attempts"
+	errShuttingDown    = "server shutting down"
+)
+
 /////////// Auth server msgs:
 
+// Highest auth protocol version spoken by this client:
+// 1 - MD5 of (nonce + secret)
+// 2 - HMAC-SHA256 of the nonce keyed with the secret
+const authProtocolVersion = 2
+
+// Message from client to auth-server requesting a nonce. Version 1 clients
+// send an arbitrary non-JSON payload instead.
+type NonceReqMessage struct {
+	Version int    // highest auth protocol version the client speaks
+	Cookie  string // echoed from a CookieMessage
+}
+
 // Message containing a nonce from auth-server.
 type NonceMessage struct {
-	Nonce int64
+	Nonce   int64
+	Version int // auth protocol version chosen by the server, 0 means 1
 }
 
-// Message containing an MD5 hash from client to auth-server.
+// Reply to a nonce request from an aserver that wants its cookie echoed
+// before it issues a nonce.
+type CookieMessage struct {
+	Cookie string
+}
+
+// Message containing a hash from client to auth-server.
 type HashMessage struct {
-	Hash string
+	Hash     string
+	Version  int    // auth protocol version used to compute Hash, 0 means 1
+	ClientID string // selects the client's secret, empty for the shared secret
+	Encrypt  bool   // seal the rest of the exchange with the session key
 }
 
 // Message with details for contacting the fortune-server.
 type FortuneInfoMessage struct {
 	FortuneServer string
 	FortuneNonce  int64
+	Ticket        string // signed ticket, in place of the nonce in ticket mode
 }
 
 /////////// Fortune server msgs:
@@ -48,6 +132,8 @@ type FortuneInfoMessage struct {
 // Message requesting a fortune from the fortune-server.
 type FortuneReqMessage struct {
 	FortuneNonce int64
+	Category     string // optional fortune category
+	Ticket       string // passed on from the FortuneInfoMessage
 }
 
 // Response from the fortune-server containing the fortune.
@@ -56,14 +142,149 @@ type FortuneMessage struct {
 }
 
 /*Usage:
-$ go run client.go [local UDP ip:port] [aserver UDP ip:port] [secret]
+$ go run client.go [flags] [local UDP ip:port] [aserver UDP ip:port] [secret]
 
 Example:
 $ go run client.go 127.0.0.1:2020 198.162.52.206:1999 1984
+$ go run client.go -id alice 127.0.0.1:2020 198.162.52.206:1999 1984
 
 */
 
-func dialServer(laddr string, raddr string) *net.UDPConn {
+// client id sent to the aserver, empty when using the shared secret
+var clientID string
+
+// fortune category requested from the fserver, empty for any
+var category string
+
+// id of the last request sent, starting at a random value
+var requestID = rand.Uint64()
+
+// wait for the first reply at each step, doubled on every retransmission
+var timeout time.Duration
+
+// sends of each request before giving up on the server
+var attempts int
+
+// ask for an encrypted session
+var encrypt bool
+
+// session key of an encrypted session, set once the hash is computed;
+// replies other than plaintext errors must then be sealed with it
+var sessionKey []byte
+
+// largest datagram read from the servers
+const maxDatagram = 65535
+
+// "udp", or "tcp" for messages framed by their length on a stream
+var transport string
+
+// largest frame read from a stream
+const maxFrame = 1 << 20
+
+// An ErrMessage from a server, or a reply that makes no sense.
+type serverError struct {
+	server string
+	text   string
+}
+
+func (e *serverError) Error() string {
+	return e.server + ": " + e.text
+}
+
+// A server that did not answer any attempt at a request.
+type unreachableError struct {
+	server string
+	err    error // from the last attempt
+}
+
+func (e *unreachableError) Error() string {
+	if transport == "tcp" {
+		return fmt.Sprintf("%s: %s", e.server, e.err)
+	}
+	return fmt.Sprintf("%s: no reply after %d attempts (%s)", e.server, attempts, e.err)
+}
+
+// A cookie from the aserver, to be echoed in the nonce request.
+type cookieReply struct {
+	server string
+	cookie string
+}
+
+func (e *cookieReply) Error() string {
+	return fmt.Sprintf("%s: sent another cookie", e.server)
+}
+
+// Whether err is the server's answer, rather than a failure to get one
+func answered(err error) bool {
+	switch err.(type) {
+	case nil, *serverError, *cookieReply:
+		return true
+	}
+	return false
+}
+
+// A kind of failure, reported with its own exit code.
+type failure struct {
+	code  int
+	what  string
+	retry bool // a new handshake may succeed
+}
+
+// Exit code 1 is left to bad arguments and local errors
+var (
+	failUnreachable = failure{2, "server unreachable", true}
+	failAuth        = failure{3, "authentication rejected", false}
+	failNonce       = failure{4, "nonce rejected", true}
+	failNoFserver   = failure{5, "fortune servers unavailable", true}
+	failCategory    = failure{6, "fortune category rejected", false}
+	failProtocol    = failure{7, "protocol error", false}
+)
+
+// Returns the kind of failure err is
+func classify(err error) failure {
+	if _, ok := err.(*unreachableError); ok {
+		return failUnreachable
+	}
+	// a second cookie means the first was not accepted
+	if _, ok := err.(*cookieReply); ok {
+		return failNonce
+	}
+	se, ok := err.(*serverError)
+	if !ok {
+		return failProtocol
+	}
+
+	switch se.text {
+	case errShuttingDown:
+		return failUnreachable
+	case errUnexpectedHash, errUnknownClient, errUnsupportedAuth, errNoEncryption, errEncryption,
+		errTicketEncrypt, errBadTicket, errLockedOut:
+		return failAuth
+	case errUnknownAddress, errExpiredNonce, errExpiredFortune, errUnexpectedNonce, errExpiredTicket:
+		return failNonce
+	case errNoFserver:
+		return failNoFserver
+	case errUnknownCategory:
+		return failCategory
+	}
+	return failProtocol
+}
+
+// Connects to a server from the local address, which the servers know the
+// client by. Only a failure to reach the server is returned.
+func dialServer(laddr string, raddr string) (net.Conn, error) {
+	if transport == "tcp" {
+		localAddr, err := net.ResolveTCPAddr("tcp", laddr)
+		handleError(err)
+
+		dialer := net.Dialer{LocalAddr: localAddr, Timeout: timeout}
+		conn, err := dialer.Dial("tcp", raddr)
+		if err != nil {
+			return nil, &unreachableError{raddr, err}
+		}
+		return conn, nil
+	}
+
 	serverAddr, err := net.ResolveUDPAddr("udp", raddr)
 	handleError(err)
 
@@ -72,67 +293,248 @@ func dialServer(laddr string, raddr string) *net.UDPConn {
 
 	conn, err := net.DialUDP("udp", localAddr, serverAddr)
 	handleError(err)
-	return conn
+	return conn, nil
+}
+
+// Close a connection to a server. The server closes a stream after its last
+// reply; waiting for that keeps the local address out of TIME_WAIT, so it can
+// be used for the next server.
+func closeConn(conn net.Conn) {
+	if transport == "tcp" {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		io.Copy(io.Discard, conn)
+	}
+	conn.Close()
 }
 
-func handleFserverConnection(conn net.Conn, fInfoMessage FortuneInfoMessage) string {
-	msg := make([]byte, 1024)
+// Write msg to a stream as a frame: its length as a 4 byte big-endian
+// integer, then msg
+func writeFrame(w io.Writer, msg []byte) error {
+	frame := make([]byte, 4+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+	copy(frame[4:], msg)
+	_, err := w.Write(frame)
+	return err
+}
 
-	var fortuneReqMessage FortuneReqMessage
-	fortuneReqMessage.FortuneNonce = fInfoMessage.FortuneNonce
+// Read a frame written by writeFrame
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n > maxFrame {
+		return nil, fmt.Errorf("frame of %d bytes is over %d", n, maxFrame)
+	}
+	msg := make([]byte, n)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
 
-	// Sending JSON encoding to aserver
-	jsonReqMessage, err := json.Marshal(fortuneReqMessage)
+// Sends msg of the given type in a new Envelope, sealed with the session key
+// if seal is set, and reads the reply into reply, which must be of type
+// replyType. Lost datagrams are covered by retransmitting the request with
+// exponential backoff; the servers answer a retransmission with their
+// original reply.
+func exchange(conn net.Conn, msgType string, msg interface{}, replyType string, reply interface{}, seal bool) error {
+	payload, err := json.Marshal(msg)
 	handleError(err)
 
-	// Contacting fserver with nonce + secret
-	_, err = conn.Write(jsonReqMessage)
+	requestID++
+	env := Envelope{
+		Type:      msgType,
+		Version:   envelopeVersion,
+		RequestID: requestID,
+		Payload:   payload,
+	}
+	if seal {
+		env, err = sealEnvelope(sessionKey, env)
+		handleError(err)
+	}
+	jsonEnv, err := json.Marshal(env)
 	handleError(err)
 
-	// Reading msg from aserver
-	n, err := conn.Read(msg[:])
-	handleError(err)
+	// a stream needs no retransmission, the reply may take as long as all
+	// attempts over UDP would
+	if transport == "tcp" {
+		var wait time.Duration
+		for i := 0; i < attempts; i++ {
+			wait += timeout << uint(i)
+		}
+		err = writeFrame(conn, jsonEnv)
+		if err == nil {
+			err = readReply(conn, requestID, replyType, reply, time.Now().Add(wait))
+			if answered(err) {
+				return err
+			}
+		}
+		return &unreachableError{conn.RemoteAddr().String(), err}
+	}
+
+	wait := timeout
+	for i := 0; i < attempts; i++ {
+		deadline := time.Now().Add(wait)
+		_, err = conn.Write(jsonEnv)
+		if err == nil {
+			err = readReply(conn, requestID, replyType, reply, deadline)
+			if answered(err) {
+				return err
+			}
+		}
+
+		// a refused datagram fails at once, still give the server its time
+		time.Sleep(time.Until(deadline))
+		wait *= 2
+	}
+	return &unreachableError{conn.RemoteAddr().String(), err}
+}
+
+// Reads the reply to request id into msg, which must be of the given type,
+// until deadline. Replies to other requests are stale and skipped; a cookie
+// for a nonce request is returned as a cookieReply, an ErrMessage or a reply
+// of another type as a serverError.
+func readReply(conn net.Conn, id uint64, msgType string, msg interface{}, deadline time.Time) error {
+	err := conn.SetReadDeadline(deadline)
+	if err != nil {
+		return err
+	}
 
+	buf := make([]byte, maxDatagram)
+	for {
+		var data []byte
+		if transport == "tcp" {
+			data, err = readFrame(conn)
+		} else {
+			var n int
+			n, err = conn.Read(buf)
+			data = buf[:n]
+		}
+		if err != nil {
+			return err
+		}
+
+		var env Envelope
+		if json.Unmarshal(data, &env) != nil || env.RequestID != id {
+			continue
+		}
+
+		// in an encrypted session anyone could have sent a plaintext or
+		// badly sealed reply; only errors are let through unsealed, as the
+		// aserver cannot seal before it has checked the hash
+		if sessionKey != nil && env.Type == msgSealed {
+			if env, err = openEnvelope(sessionKey, env); err != nil {
+				continue
+			}
+		} else if sessionKey != nil && env.Type != msgError {
+			continue
+		}
+
+		server := conn.RemoteAddr().String()
+		switch env.Type {
+		case msgType:
+			if json.Unmarshal(env.Payload, msg) != nil {
+				return &serverError{server, "malformed " + msgType + " reply"}
+			}
+		case msgCookie:
+			var cookie CookieMessage
+			if msgType != msgNonce || json.Unmarshal(env.Payload, &cookie) != nil {
+				return &serverError{server, "unexpected cookie reply"}
+			}
+			return &cookieReply{server, cookie.Cookie}
+		case msgError:
+			var errMessage ErrMessage
+			if json.Unmarshal(env.Payload, &errMessage) != nil {
+				return &serverError{server, "malformed error reply"}
+			}
+			return &serverError{server, errMessage.Error}
+		default:
+			return &serverError{server, fmt.Sprintf("unexpected %q reply", env.Type)}
+		}
+		return nil
+	}
+}
+
+func handleFserverConnection(conn net.Conn, fInfoMessage FortuneInfoMessage) (string, error) {
+	var fortuneReqMessage FortuneReqMessage
+	fortuneReqMessage.FortuneNonce = fInfoMessage.FortuneNonce
+	fortuneReqMessage.Category = category
+	fortuneReqMessage.Ticket = fInfoMessage.Ticket
+
+	// Contacting fserver with nonce
 	var fortuneMessage FortuneMessage
-	json.Unmarshal(msg[:n], &fortuneMessage)
+	err := exchange(conn, msgFortuneReq, fortuneReqMessage, msgFortune, &fortuneMessage, sessionKey != nil)
 
 	fortune := fortuneMessage.Fortune
-	return fortune
+	return fortune, err
 }
 
 // returns FortuneInfoMessage
-func handleAserverConnection(conn net.Conn, secret int64) FortuneInfoMessage {
-	msg := make([]byte, 1024)
-	// Contacting aserver
-	fmt.Fprintf(conn, "ping")
-	n, err := conn.Read(msg[:])
-	handleError(err)
-
-	// putting json received into nonce struct
+func handleAserverConnection(conn net.Conn, secret int64) (FortuneInfoMessage, error) {
+	// Contacting aserver, offering our highest protocol version
 	var nonce NonceMessage
-	json.Unmarshal(msg[:n], &nonce)
+	nonceReq := NonceReqMessage{Version: authProtocolVersion}
+	err := exchange(conn, msgNonceReq, nonceReq, msgNonce, &nonce, false)
+
+	// an aserver guarding against spoofed addresses first sends a cookie,
+	// which proves we receive at ours when we send it back
+	if cookie, ok := err.(*cookieReply); ok {
+		nonceReq.Cookie = cookie.cookie
+		err = exchange(conn, msgNonceReq, nonceReq, msgNonce, &nonce, false)
+	}
+	if err != nil {
+		return FortuneInfoMessage{}, err
+	}
 
+	// answer with the version the server picked
 	var hashMessage HashMessage
-	hashMessage.Hash = computeNonceSecretHash(nonce.Nonce, secret)
+	hashMessage.ClientID = clientID
+	if nonce.Version >= 2 {
+		hashMessage.Hash = computeNonceHMAC(nonce.Nonce, secret)
+		hashMessage.Version = 2
+	} else {
+		hashMessage.Hash = computeNonceSecretHash(nonce.Nonce, secret)
+		hashMessage.Version = 1
+	}
 
-	// Sending JSON encoding to aserver
-	jsonMD5, err := json.Marshal(hashMessage)
-	handleError(err)
+	// the session key is derived like the version 2 hash
+	if encrypt {
+		if hashMessage.Version < 2 {
+			return FortuneInfoMessage{}, &serverError{conn.RemoteAddr().String(), errNoEncryption}
+		}
+		hashMessage.Encrypt = true
+		sessionKey = computeSessionKey(nonce.Nonce, secret)
+	}
 
 	// Contacting aserver with nonce + secret
-	_, err = conn.Write(jsonMD5)
-	handleError(err)
+	var fInfoMessage FortuneInfoMessage
+	err = exchange(conn, msgHash, hashMessage, msgFortuneInfo, &fInfoMessage, false)
 
-	// Reading msg from aserver
-	n, err = conn.Read(msg[:])
-	handleError(err)
-	conn.Close()
+	return fInfoMessage, err
+}
 
-	// putting json received into Fortune struct
-	var fInfoMessage FortuneInfoMessage
-	json.Unmarshal(msg[:n], &fInfoMessage)
+// Runs the whole handshake once, returning the fortune
+func getFortune(local string, aserver string, secret int64) (string, error) {
+	sessionKey = nil
 
-	return fInfoMessage
+	// contact Aserver, closing the connection to free the local address
+	conn, err := dialServer(local, aserver)
+	if err != nil {
+		return "", err
+	}
+	fInfoMessage, err := handleAserverConnection(conn, secret)
+	closeConn(conn)
+	if err != nil {
+		return "", err
+	}
+
+	// connecting to FortuneServer
+	conn, err = dialServer(local, fInfoMessage.FortuneServer)
+	if err != nil {
+		return "", err
+	}
+	defer closeConn(conn)
+	return handleFserverConnection(conn, fInfoMessage)
 }
 
 // Returns the MD5 hash as a hex string for the (nonce + secret) value.
@@ -146,6 +548,104 @@ func computeNonceSecretHash(nonce int64, secret int64) string {
 	return str
 }
 
+// Returns the HMAC-SHA256 of the nonce keyed with the secret as a hex string,
+// both encoded as 8 byte big-endian integers.
+func computeNonceHMAC(nonce int64, secret int64) string {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(secret))
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(nonce))
+
+	h := hmac.New(sha256.New, key)
+	h.Write(msg)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns the session key of an encrypted session: the HMAC-SHA256 of
+// "session" and the nonce, keyed with the secret, both encoded as 8 byte
+// big-endian integers.
+func computeSessionKey(nonce int64, secret int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(secret))
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(nonce))
+
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("session"))
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// Returns an AES-256-GCM cipher keyed with a session key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns env encrypted under key in a sealed envelope with its request id
+func sealEnvelope(key []byte, env Envelope) (Envelope, error) {
+	plain, err := json.Marshal(env)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return Envelope{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		return Envelope{}, err
+	}
+
+	payload, err := json.Marshal(SealedMessage{
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plain, nil),
+	})
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{
+		Type:      msgSealed,
+		Version:   envelopeVersion,
+		RequestID: env.RequestID,
+		Payload:   payload,
+	}, nil
+}
+
+// Returns the envelope sealed in env, which must have been sealed under key
+// with the same request id
+func openEnvelope(key []byte, env Envelope) (Envelope, error) {
+	var sealed SealedMessage
+	if err := json.Unmarshal(env.Payload, &sealed); err != nil {
+		return Envelope{}, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return Envelope{}, err
+	}
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return Envelope{}, errors.New("bad sealed nonce size")
+	}
+	plain, err := aead.Open(nil, sealed.Nonce, sealed.Ciphertext, nil)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	var inner Envelope
+	if err := json.Unmarshal(plain, &inner); err != nil {
+		return Envelope{}, err
+	}
+	if inner.RequestID != env.RequestID {
+		return Envelope{}, errors.New("sealed request id does not match")
+	}
+	return inner, nil
+}
+
 // If err is non-nil, print it out and halt.
 func handleError(err error) {
 	if err != nil {
@@ -157,29 +657,58 @@ func handleError(err error) {
 // Main
 func main() {
 	
+	flag.StringVar(&clientID, "id", "", "client id whose secret is given, if the aserver has per-client credentials")
+	flag.StringVar(&category, "category", "", "fortune category to ask the fserver for")
+	flag.DurationVar(&timeout, "timeout", 500*time.Millisecond,
+		"wait for the first reply to a request, doubled on each retransmission")
+	flag.IntVar(&attempts, "attempts", 5, "sends of each request before giving up")
+	flag.StringVar(&transport, "transport", "udp",
+		"udp, or tcp for messages framed by a 4 byte length on a stream")
+	flag.BoolVar(&encrypt, "encrypt", false,
+		"seal the fortune nonce and fortune with a session key (auth protocol version 2)")
+	retries := flag.Int("retries", 0,
+		"times the handshake is started over after a recoverable failure")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [local UDP ip:port] [aserver UDP ip:port] [secret]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 3 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if timeout <= 0 || attempts <= 0 || *retries < 0 {
+		fmt.Fprintln(os.Stderr, "timeout and attempts must be positive, retries not negative")
+		os.Exit(1)
+	}
+	if transport != "udp" && transport != "tcp" {
+		fmt.Fprintf(os.Stderr, "unknown transport %q\n", transport)
+		os.Exit(1)
+	}
+
 	//var msg[] byte
-	local := os.Args[1]
-	aserver := os.Args[2]
-	secretString := os.Args[3]
+	local := flag.Arg(0)
+	aserver := flag.Arg(1)
+	secretString := flag.Arg(2)
 
 	// secret to 64 bit
 	secret, err := strconv.ParseInt(secretString, 10, 64)
 	handleError(err)
 
-	// contact Aserver
-	conn := dialServer(local, aserver)
-	defer conn.Close()
-	//hashMessage := handleAserverConnection(conn, secret)
-
-	// Get FortuneInfoMessage
-	fInfoMessage := handleAserverConnection(conn, secret)
-	
-	// connecting to FortuneServer
-	conn = dialServer(local, fInfoMessage.FortuneServer)
-	defer conn.Close()
-	// Get Fortune
-	fortune := handleFserverConnection(conn, fInfoMessage)
-
-	// Fortune message received from fserver
-	fmt.Println(fortune)
+	for try := 0; ; try++ {
+		fortune, err := getFortune(local, aserver, secret)
+		if err == nil {
+			// Fortune message received from fserver
+			fmt.Println(fortune)
+			return
+		}
+
+		f := classify(err)
+		if !f.retry || try == *retries {
+			fmt.Fprintf(os.Stderr, "Error: %s: %s\n", f.what, err)
+			os.Exit(f.code)
+		}
+		fmt.Fprintf(os.Stderr, "Retrying after %s: %s\n", f.what, err)
+		time.Sleep(timeout)
+	}
 }
@@ -0,0 +1,160 @@
+// go test client.go client_test.go
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Both hash encodings, pinned so that client and aserver agree (p2 pins the
+// same values)
+func TestHashEncodings(t *testing.T) {
+	cases := []struct {
+		nonce, secret int64
+		md5, hmac     string
+	}{
+		{2016, 42, "77d81d10067374492e42233468c778b3",
+			"7c86c07579f56dea462315e6cb42fc3e9292d6d1d0b17129ccdb1dd0a0ab0572"},
+		{-5, 3, "8666683506aacd900bbd5a74ac4edf68",
+			"be1df2193821a84486f6caa24d36222f8b522337ec2d27caf39aa97d3af52148"},
+		{9223372036854775807, 1, "f2802cd26b5c7c75c96016023bed5279",
+			"6a19a3e1bfa46fba4eccdc503d0f07d572aead8df8e764c93a17f861ae04872e"},
+	}
+	for _, c := range cases {
+		if got := computeNonceSecretHash(c.nonce, c.secret); got != c.md5 {
+			t.Errorf("MD5 hash of %d, %d = %s, want %s", c.nonce, c.secret, got, c.md5)
+		}
+		if got := computeNonceHMAC(c.nonce, c.secret); got != c.hmac {
+			t.Errorf("HMAC of %d, %d = %s, want %s", c.nonce, c.secret, got, c.hmac)
+		}
+	}
+}
+
+// Answers one handshake as an aserver speaking the given version would,
+// sending back the client's nonce request and hash
+func fakeAserver(t *testing.T, conn *net.UDPConn, version int, nonce int64, got chan<- []Envelope) {
+	var envs []Envelope
+	defer func() { got <- envs }()
+
+	replies := []struct {
+		msgType string
+		msg     interface{}
+	}{
+		{msgNonce, NonceMessage{Nonce: nonce, Version: version}},
+		{msgFortuneInfo, FortuneInfoMessage{FortuneServer: "127.0.0.1:1", FortuneNonce: 1}},
+	}
+	buf := make([]byte, maxDatagram)
+	for _, reply := range replies {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var env Envelope
+		if err := json.Unmarshal(buf[:n], &env); err != nil {
+			t.Error(err)
+			return
+		}
+		envs = append(envs, env)
+
+		env.Type = reply.msgType
+		env.Payload, _ = json.Marshal(reply.msg)
+		data, _ := json.Marshal(env)
+		conn.WriteToUDP(data, addr)
+	}
+}
+
+// The client offers version 2 and hashes with whichever version the aserver
+// picks
+func TestHashVersionNegotiation(t *testing.T) {
+	timeout, attempts, transport = time.Second, 1, "udp"
+	encrypt, sessionKey = false, nil
+
+	cases := []struct {
+		version int
+		hash    func(int64, int64) string
+	}{
+		{0, computeNonceSecretHash},
+		{1, computeNonceSecretHash},
+		{2, computeNonceHMAC},
+	}
+	for _, c := range cases {
+		server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(chan []Envelope, 1)
+		go fakeAserver(t, server, c.version, 2016, got)
+
+		conn, err := dialServer("127.0.0.1:0", server.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = handleAserverConnection(conn, 42)
+		conn.Close()
+		server.Close()
+		if err != nil {
+			t.Fatalf("version %d: %s", c.version, err)
+		}
+
+		envs := <-got
+		if len(envs) != 2 {
+			t.Fatalf("version %d: aserver got %d messages, want 2", c.version, len(envs))
+		}
+		var nonceReq NonceReqMessage
+		var hash HashMessage
+		json.Unmarshal(envs[0].Payload, &nonceReq)
+		json.Unmarshal(envs[1].Payload, &hash)
+		if nonceReq.Version != authProtocolVersion {
+			t.Errorf("version %d: offered version %d, want %d", c.version, nonceReq.Version, authProtocolVersion)
+		}
+		if want := c.hash(2016, 42); hash.Hash != want {
+			t.Errorf("version %d: got hash %s, want %s", c.version, hash.Hash, want)
+		}
+	}
+}
+
+// Frames of any size up to maxFrame come back as written, one at a time
+func TestFrameRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, 1023, 1024, 1025, 64 << 10, maxFrame}
+	var stream bytes.Buffer
+	for i, n := range sizes {
+		if err := writeFrame(&stream, bytes.Repeat([]byte{byte(i)}, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, n := range sizes {
+		msg, err := readFrame(&stream)
+		if err != nil || !bytes.Equal(msg, bytes.Repeat([]byte{byte(i)}, n)) {
+			t.Fatalf("frame %d: read %d bytes, %v; want %d", i, len(msg), err, n)
+		}
+	}
+	if _, err := readFrame(&stream); err != io.EOF {
+		t.Fatalf("got %v at the end of the stream, want EOF", err)
+	}
+}
+
+// Oversize and cut short frames are errors
+func TestBadFrames(t *testing.T) {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], maxFrame+1)
+	if _, err := readFrame(bytes.NewReader(header[:])); err == nil {
+		t.Error("frame over maxFrame read")
+	}
+	if _, err := readFrame(bytes.NewReader(header[:2])); err != io.ErrUnexpectedEOF {
+		t.Errorf("cut short header: got %v, want ErrUnexpectedEOF", err)
+	}
+
+	var stream bytes.Buffer
+	writeFrame(&stream, []byte("fortune"))
+	if _, err := readFrame(bytes.NewReader(stream.Bytes()[:stream.Len()-1])); err != io.ErrUnexpectedEOF {
+		t.Errorf("cut short frame: got %v, want ErrUnexpectedEOF", err)
+	}
+}
@@ -6,65 +6,450 @@ Implements the solution to assignment 2 for UBC CS 416 2015 W2.
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/md5"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net"
+	"net/http"
 	"net/rpc"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // Global variables
 //////////////////////////////
 
-// secret
+// secret shared by clients that do not send a client id
 var secret int64
+var hasSharedSecret bool
+
+// per-client secrets loaded from the credentials file
+var credentials = struct {
+	sync.RWMutex
+	path    string
+	modTime time.Time
+	m       map[string]int64
+}{m: make(map[string]int64)}
+
+// lowest auth protocol version accepted from clients
+var minAuthVersion int
+
+// how long an issued nonce may be answered
+var nonceTTL time.Duration
+
+// reject clients that do not ask for an encrypted session
+var requireEncryption bool
 
 // global aserver local address
 var aserverUdpAddrG string
 
-// global fserver address
-var fserverG string
-
 // global udp connect
 var conndp *net.UDPConn
 
-// client and md5 hash mapping (possibly official map)
+// largest datagram read from clients
+const maxDatagram = 1024
+
+// A datagram from a client, in its own buffer.
+type packet struct {
+	buf        []byte
+	clientAddr string
+}
+
+// client and issued nonce mapping (possibly official map); the expected hash
+// depends on the client id in the HashMessage, so it is computed on arrival.
+// Entries are removed on the first HashMessage and after nonceTTL.
 var aserverClientMD5Map = struct {
 	sync.RWMutex
-	m map[string]HashMessage
-}{m: make(map[string]HashMessage)}
+	m map[string]challenge
+}{m: make(map[string]challenge)}
+
+// Nonce issued to a client, awaiting its HashMessage.
+type challenge struct {
+	Nonce   int64
+	Version int // negotiated auth protocol version
+	Issued  time.Time
+}
+
+// Remove nonces that were never answered
+func expireChallenges() {
+	for range time.Tick(nonceTTL / 2) {
+		aserverClientMD5Map.Lock()
+		for clientAddr, c := range aserverClientMD5Map.m {
+			if time.Since(c.Issued) > nonceTTL {
+				delete(aserverClientMD5Map.m, clientAddr)
+			}
+		}
+		aserverClientMD5Map.Unlock()
+	}
+}
+
+// Abuse protection
+//////////////////////////////
+
+// nonce requests allowed per second from one client IP, and in a burst; a
+// rate of 0, the default, turns the limit off
+var nonceRate float64
+var nonceBurst int
+
+// most nonces awaiting a HashMessage
+var maxChallenges int
+
+// unexpected hashes in a row that lock a client IP out, 0 (the default) for
+// never, and how long the lockout lasts
+var lockoutFailures int
+var lockoutPeriod time.Duration
+
+// Rate and failures of one client IP
+type source struct {
+	tokens      float64
+	refilled    time.Time
+	seen        time.Time
+	failures    int // unexpected hashes since the last good one
+	lockedUntil time.Time
+}
+
+var sources = struct {
+	sync.Mutex
+	m map[string]*source
+}{m: make(map[string]*source)}
+
+// Requests turned away and failures, logged by logLimitStats
+var limitStats struct {
+	rateLimited    atomic.Int64 // nonce requests over the rate, dropped
+	capped         atomic.Int64 // nonce requests while maxChallenges were outstanding, dropped
+	lockedOut      atomic.Int64 // nonce requests from locked out IPs
+	lockouts       atomic.Int64
+	unexpectedHash atomic.Int64
+}
+
+// Clients behind one IP share its limits
+func sourceIP(clientAddr string) string {
+	host, _, err := net.SplitHostPort(clientAddr)
+	if err != nil {
+		return clientAddr
+	}
+	return host
+}
+
+// Whether a nonce may be issued to the client. Requests over the client
+// IP's rate are dropped without a reply, so spoofed requests are not
+// reflected; locked out clients are told so.
+func admitNonceRequest(req request) bool {
+	if nonceRate == 0 && lockoutFailures == 0 {
+		return true
+	}
+
+	ip := sourceIP(req.clientAddr)
+	now := time.Now()
+
+	sources.Lock()
+	s := sources.m[ip]
+	if s == nil {
+		s = &source{tokens: float64(nonceBurst), refilled: now}
+		sources.m[ip] = s
+	}
+	s.seen = now
+	limited := false
+	if nonceRate > 0 {
+		s.tokens = math.Min(float64(nonceBurst), s.tokens+now.Sub(s.refilled).Seconds()*nonceRate)
+		s.refilled = now
+		if s.tokens < 1 {
+			limited = true
+		} else {
+			s.tokens--
+		}
+	}
+	locked := lockoutFailures > 0 && now.Before(s.lockedUntil)
+	sources.Unlock()
+
+	if limited {
+		limitStats.rateLimited.Add(1)
+		forgetRequest(req)
+		return false
+	}
+	if locked {
+		limitStats.lockedOut.Add(1)
+		sendError(req, errLockedOut)
+		return false
+	}
+	return true
+}
+
+// Count an unexpected hash against the client IP, locking it out after
+// lockoutFailures in a row; a good hash clears the count
+func recordHashResult(clientAddr string, ok bool) {
+	if !ok {
+		limitStats.unexpectedHash.Add(1)
+	}
+	if lockoutFailures == 0 {
+		return
+	}
+
+	ip := sourceIP(clientAddr)
+	now := time.Now()
+
+	sources.Lock()
+	s := sources.m[ip]
+	if s == nil {
+		s = &source{tokens: float64(nonceBurst), refilled: now}
+		sources.m[ip] = s
+	}
+	s.seen = now
+	locked := false
+	if ok {
+		s.failures = 0
+	} else if s.failures++; s.failures >= lockoutFailures {
+		s.failures = 0
+		s.lockedUntil = now.Add(lockoutPeriod)
+		locked = true
+	}
+	sources.Unlock()
+
+	if locked {
+		limitStats.lockouts.Add(1)
+		log.Printf("client %s: locked out for %s after %d unexpected hashes", ip, lockoutPeriod, lockoutFailures)
+	}
+}
+
+// Forget client IPs that have been quiet long enough to have a full bucket
+// and no lockout; their failures are forgiven with them
+func expireSources() {
+	ttl := lockoutPeriod
+	if nonceRate > 0 {
+		refill := time.Duration(float64(nonceBurst) / nonceRate * float64(time.Second))
+		if refill > ttl {
+			ttl = refill
+		}
+	}
+	for range time.Tick(ttl / 2) {
+		now := time.Now()
+		sources.Lock()
+		for ip, s := range sources.m {
+			if now.Sub(s.seen) > ttl && now.After(s.lockedUntil) {
+				delete(sources.m, ip)
+			}
+		}
+		sources.Unlock()
+	}
+}
+
+// Address cookies
+//////////////////////////////
+
+// nonce requests over UDP must echo a cookie first
+var cookies bool
+
+// how long a cookie can be echoed
+var cookieTTL time.Duration
+
+// key of the cookie MACs, fresh on every start
+var cookieKey []byte
+
+// MAC of the client address and the time the cookie was made
+func cookieMAC(clientAddr string, made int64) []byte {
+	mac := hmac.New(sha256.New, cookieKey)
+	fmt.Fprintf(mac, "%s|%d", clientAddr, made)
+	return mac.Sum(nil)
+}
+
+// A cookie for the client address: the Unix time it was made and its MAC,
+// "time.hex-mac". Nothing is kept; the MAC is checked when it comes back.
+func makeCookie(clientAddr string) string {
+	made := time.Now().Unix()
+	return fmt.Sprintf("%d.%s", made, hex.EncodeToString(cookieMAC(clientAddr, made)))
+}
+
+// Whether cookie was made for the client address within cookieTTL
+func checkCookie(clientAddr string, cookie string) bool {
+	madeStr, macHex, ok := strings.Cut(cookie, ".")
+	if !ok {
+		return false
+	}
+	made, err := strconv.ParseInt(madeStr, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := time.Since(time.Unix(made, 0))
+	if age < -time.Second || age > cookieTTL {
+		return false
+	}
+	mac, err := hex.DecodeString(macHex)
+	return err == nil && hmac.Equal(mac, cookieMAC(clientAddr, made))
+}
+
+// Whether a UDP client has shown it receives at its address without an
+// echoed cookie: it holds a nonce, which was only sent after a cookie came
+// back, or repeats a request that was answered. Nothing is allocated.
+func verifiedAddress(req request) bool {
+	aserverClientMD5Map.RLock()
+	_, ok := aserverClientMD5Map.m[req.clientAddr]
+	aserverClientMD5Map.RUnlock()
+	if ok {
+		return true
+	}
+
+	replyCache.Lock()
+	_, ok = replyCache.m[replyKey{req.clientAddr, req.envelope.RequestID}]
+	replyCache.Unlock()
+	return ok
+}
+
+// Periodically log the abuse protection counters
+func logLimitStats(interval time.Duration) {
+	for range time.Tick(interval) {
+		aserverClientMD5Map.RLock()
+		outstanding := len(aserverClientMD5Map.m)
+		aserverClientMD5Map.RUnlock()
+		sources.Lock()
+		tracked := len(sources.m)
+		sources.Unlock()
+
+		log.Printf("limits: %d outstanding nonces, %d client IPs tracked, %d rate limited, "+
+			"%d over the nonce cap, %d locked out, %d lockouts, %d unexpected hashes",
+			outstanding, tracked, limitStats.rateLimited.Load(), limitStats.capped.Load(),
+			limitStats.lockedOut.Load(), limitStats.lockouts.Load(), limitStats.unexpectedHash.Load())
+	}
+}
 
 /////////// Msgs used by both auth and fortune servers:
 
+// Envelope version spoken by this server
+const envelopeVersion = 1
+
+// Envelope around every message from clients that speak it. Clients that
+// predate it send bare messages and get bare replies.
+type Envelope struct {
+	Type      string          // one of the msg* types below
+	Version   int             // envelope version
+	RequestID uint64          // chosen by the client, echoed in the reply
+	Payload   json.RawMessage // message of the given type
+}
+
+// Envelope message types
+const (
+	msgError       = "error"        // ErrMessage
+	msgNonceReq    = "nonce-req"    // NonceReqMessage
+	msgNonce       = "nonce"        // NonceMessage
+	msgHash        = "hash"         // HashMessage
+	msgFortuneInfo = "fortune-info" // FortuneInfoMessage
+	msgFortuneReq  = "fortune-req"  // FortuneReqMessage
+	msgFortune     = "fortune"      // FortuneMessage
+	msgSealed      = "sealed"       // SealedMessage
+	msgCookie      = "cookie"       // CookieMessage
+)
+
 // An error message from the server.
 type ErrMessage struct {
 	Error string
 }
 
+// Errors sent in ErrMessage
+const (
+	errUnknownAddress      = "unknown remote client address"
+	errUnexpectedHash      = "unexpected hash value"
+	errExpiredNonce        = "expired nonce"
+	errUnknownClient       = "unknown client id"
+	errUnsupportedAuth     = "unsupported auth protocol version"
+	errNoFserver           = "no fortune server available"
+	errMalformed           = "could not interpret message"
+	errUnknownType         = "unknown message type"
+	errUnsupportedEnvelope = "unsupported envelope version"
+	errNoEncryption        = "encryption needs auth protocol version 2 and the envelope"
+	errEncryptionRequired  = "encryption required"
+	errTicketEncryption    = "encryption is not available with tickets"
+	errLockedOut           = "too many failed attempts"
+	errShuttingDown        = "server shutting down"
+)
+
+// Payload of a "sealed" envelope: another envelope with the same request id,
+// encrypted and authenticated with AES-256-GCM under the session key.
+type SealedMessage struct {
+	Nonce      []byte // random, one per message
+	Ciphertext []byte
+}
+
 /////////// Auth server msgs:
 
+// Highest auth protocol version spoken by this server:
+// 1 - MD5 of (nonce + secret)
+// 2 - HMAC-SHA256 of the nonce keyed with the secret
+const authProtocolVersion = 2
+
+// Message from client to auth-server requesting a nonce. Version 1 clients
+// send an arbitrary non-JSON payload instead.
+type NonceReqMessage struct {
+	Version int    // highest auth protocol version the client speaks
+	Cookie  string // echoed from a CookieMessage
+}
+
 // Message containing a nonce from auth-server.
 type NonceMessage struct {
-	Nonce int64
+	Nonce   int64
+	Version int // auth protocol version chosen by the server, 0 means 1
+}
+
+// Reply to a nonce request without a valid cookie from an aserver run with
+// -cookies; the client sends the request again with the cookie.
+type CookieMessage struct {
+	Cookie string
 }
 
-// Message containing an MD5 hash from client to auth-server.
+// Message containing a hash from client to auth-server.
 type HashMessage struct {
-	Hash string
+	Hash     string
+	Version  int    // auth protocol version used to compute Hash, 0 means 1
+	ClientID string // selects the client's secret, empty for the shared secret
+	Encrypt  bool   // seal the rest of the exchange with the session key
 }
 
 // Message with details for contacting the fortune-server.
 type FortuneInfoMessage struct {
 	FortuneServer string
 	FortuneNonce  int64
+	Ticket        string // signed Ticket, in place of the nonce in ticket mode
+}
+
+// A fortune ticket, issued instead of a fortune nonce: the client at
+// ClientAddr may ask the fserver at FortuneServer for fortunes until Expiry.
+// It travels as base64(JSON) "." base64(signature over the first part).
+type Ticket struct {
+	ClientAddr    string
+	FortuneServer string // UDP ip:port of the fserver
+	Expiry        int64  // Unix time
+}
+
+// Arguments of FortuneServerRPC.GetSessionFortuneInfo.
+type SessionFortuneArgs struct {
+	ClientAddr string
+	Key        []byte // session key the client seals its FortuneReqMessage with
 }
 
 /////////// Fortune server msgs:
@@ -72,6 +457,7 @@ type FortuneInfoMessage struct {
 // Message requesting a fortune from the fortune-server.
 type FortuneReqMessage struct {
 	FortuneNonce int64
+	Category     string // optional fortune category
 }
 
 // Response from the fortune-server containing the fortune.
@@ -79,6 +465,8 @@ type FortuneMessage struct {
 	Fortune string
 }
 
+// Halt on a startup error. Errors while serving a client are logged
+// instead, a bad client must not take the server down for everyone.
 func handleError(err error) {
 	if err != nil {
 		fmt.Println("Error: ", err)
@@ -97,95 +485,921 @@ func computeNonceSecretHash(nonce int64, secret int64) string {
 	return str
 }
 
-func sendUnknownAddressError(clientAddr string) {
-	var error ErrMessage
-	error.Error = "unknown remote client address"
+// Returns the HMAC-SHA256 of the nonce keyed with the secret as a hex string,
+// both encoded as 8 byte big-endian integers.
+func computeNonceHMAC(nonce int64, secret int64) string {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(secret))
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(nonce))
+
+	h := hmac.New(sha256.New, key)
+	h.Write(msg)
+	return hex.EncodeToString(h.Sum(nil))
+}
 
-	// encoding ErrorMessage to JSON to aserver
-	jsonError, err := json.Marshal(error)
-	handleError(err)
+// Returns the session key of a client that asked for encryption: the
+// HMAC-SHA256 of "session" and the nonce, keyed with the secret, both encoded
+// as 8 byte big-endian integers.
+func computeSessionKey(nonce int64, secret int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(secret))
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(nonce))
+
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte("session"))
+	h.Write(msg)
+	return h.Sum(nil)
+}
 
-	// client address
-	clientUdpAddr, err := net.ResolveUDPAddr("udp", clientAddr)
-	handleError(err)
+// Returns an AES-256-GCM cipher keyed with a session key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
 
-	// sending ErrorMessage
-	_, err = conndp.WriteToUDP(jsonError, clientUdpAddr)
-	handleError(err)
+// Returns env encrypted under key in a sealed envelope with its request id
+func sealEnvelope(key []byte, env Envelope) (Envelope, error) {
+	plain, err := json.Marshal(env)
+	if err != nil {
+		return Envelope{}, err
+	}
 
+	aead, err := newAEAD(key)
+	if err != nil {
+		return Envelope{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		return Envelope{}, err
+	}
+
+	payload, err := json.Marshal(SealedMessage{
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plain, nil),
+	})
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{
+		Type:      msgSealed,
+		Version:   envelopeVersion,
+		RequestID: env.RequestID,
+		Payload:   payload,
+	}, nil
 }
 
-func sendUnexpectedHashValueError(clientAddr string) {
-	var error ErrMessage
-	error.Error = "unexpected hash value"
+// Fortune tickets
+//////////////////////////////
 
-	// encoding ErrorMessage to JSON to aserver
-	jsonError, err := json.Marshal(error)
-	handleError(err)
+// "hmac" or "ed25519" in ticket mode, where clients get a signed Ticket
+// instead of a fortune nonce from a GetFortuneInfo call; empty otherwise
+var ticketAlg string
+var ticketHMACKey []byte
+var ticketPrivateKey ed25519.PrivateKey
 
-	// client address
-	clientUdpAddr, err := net.ResolveUDPAddr("udp", clientAddr)
-	handleError(err)
+// how long a ticket is valid
+var ticketTTL time.Duration
 
-	// sending ErrorMessage
-	_, err = conndp.WriteToUDP(jsonError, clientUdpAddr)
-	handleError(err)
+// Load the ticket signing key: at least 32 hex-encoded bytes shared with the
+// fservers for hmac, a PKCS #8 PEM private key for ed25519
+func loadTicketKey(alg string, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch alg {
+	case "hmac":
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		if len(key) < 32 {
+			return fmt.Errorf("%s: hmac key shorter than 32 bytes", path)
+		}
+		ticketHMACKey = key
+	case "ed25519":
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("%s: no PEM data", path)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		privateKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return fmt.Errorf("%s: not an ed25519 private key", path)
+		}
+		ticketPrivateKey = privateKey
+	default:
+		return fmt.Errorf("unknown ticket algorithm %q", alg)
+	}
+	ticketAlg = alg
+	return nil
 }
 
-func sendFserverInfo(fInfoMsg FortuneInfoMessage, clientAddr string) {
+// Returns the signed, encoded ticket
+func signTicket(t Ticket) (string, error) {
+	body, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(body)
 
-	// encoding fInfoMsg to JSON to aserver
-	jsonFim, err := json.Marshal(fInfoMsg)
-	handleError(err)
+	var sig []byte
+	if ticketAlg == "hmac" {
+		h := hmac.New(sha256.New, ticketHMACKey)
+		h.Write([]byte(signed))
+		sig = h.Sum(nil)
+	} else {
+		sig = ed25519.Sign(ticketPrivateKey, []byte(signed))
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
 
-	// client address
-	clientUdpAddr, err := net.ResolveUDPAddr("udp", clientAddr)
-	handleError(err)
+// Send the client a ticket for a healthy fserver, which needs no call to it
+func issueTicket(req request) {
+	backend := pickFserver(req.clientAddr)
+	if backend == nil {
+		sendError(req, errNoFserver)
+		return
+	}
+	fserverPool.Lock()
+	fserverAddr := backend.udpAddr
+	fserverPool.Unlock()
+	releaseFserver(backend, nil)
+
+	// an fserver that does not report its address cannot take tickets
+	if fserverAddr == "" {
+		sendError(req, errNoFserver)
+		return
+	}
 
-	// sending fInfoMsg
-	_, err = conndp.WriteToUDP(jsonFim, clientUdpAddr)
-	handleError(err)
+	ticket, err := signTicket(Ticket{
+		ClientAddr:    req.clientAddr,
+		FortuneServer: fserverAddr,
+		Expiry:        time.Now().Add(ticketTTL).Unix(),
+	})
+	if err != nil {
+		log.Printf("client %s: signing ticket: %s", req.clientAddr, err)
+		sendError(req, errNoFserver)
+		return
+	}
+
+	var fInfoMsg FortuneInfoMessage
+	fInfoMsg.FortuneServer = fserverAddr
+	fInfoMsg.Ticket = ticket
+	sendMessage(req, msgFortuneInfo, fInfoMsg)
 }
 
-func initiateRcpConnection(clientAddr string) {
-	// Connecting to fortune server
-	client, err := rpc.Dial("tcp", fserverG)
+// Returns the expected hash of the nonce for the given protocol version
+func computeExpectedHash(c challenge, secret int64) string {
+	if c.Version >= 2 {
+		return computeNonceHMAC(c.Nonce, secret)
+	}
+	return computeNonceSecretHash(c.Nonce, secret)
+}
+
+// Load the credentials file: one "client-id secret" pair per line, blank lines
+// and lines starting with # are ignored. The previous set stays in place if the
+// file cannot be parsed.
+func loadCredentials() error {
+	info, err := os.Stat(credentials.path)
 	if err != nil {
-		log.Fatal("Error: ", err)
-		handleError(err)
+		return err
 	}
 
-	var fInfoMsg FortuneInfoMessage
-	err = client.Call("FortuneServerRPC.GetFortuneInfo", clientAddr, &fInfoMsg)
+	file, err := os.Open(credentials.path)
 	if err != nil {
-		log.Fatal("get fortune info error:", err)
+		return err
+	}
+	defer file.Close()
+
+	m := make(map[string]int64)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected \"client-id secret\"", credentials.path, line)
+		}
+		clientSecret, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", credentials.path, line, err)
+		}
+		m[fields[0]] = clientSecret
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	credentials.Lock()
+	credentials.m = m
+	credentials.modTime = info.ModTime()
+	credentials.Unlock()
+	return nil
+}
+
+// Reload the credentials file whenever its modification time changes
+func watchCredentials(interval time.Duration) {
+	for range time.Tick(interval) {
+		info, err := os.Stat(credentials.path)
+		if err != nil {
+			log.Println("credentials:", err)
+			continue
+		}
+
+		credentials.RLock()
+		changed := !info.ModTime().Equal(credentials.modTime)
+		credentials.RUnlock()
+
+		if changed {
+			if err := loadCredentials(); err != nil {
+				log.Println("credentials not reloaded:", err)
+			} else {
+				log.Println("credentials reloaded from", credentials.path)
+			}
+		}
 	}
-	sendFserverInfo(fInfoMsg, clientAddr)
 }
 
-func processHashMessage(clientHash HashMessage, clientAddr string) {
-	aserverClientMD5Map.Lock()
-	if hash, ok := aserverClientMD5Map.m[clientAddr]; ok {
+// Returns the secret for a client id, or the shared secret for no id
+func lookupSecret(clientID string) (int64, bool) {
+	if clientID == "" {
+		return secret, hasSharedSecret
+	}
+
+	credentials.RLock()
+	defer credentials.RUnlock()
+	clientSecret, ok := credentials.m[clientID]
+	return clientSecret, ok
+}
+
+// Fortune server pool
+//////////////////////////////
+
+// Health report from an fserver, mirrors the fserver's type.
+type FortuneServerHealth struct {
+	Pending int    // unused fortune nonces, a measure of load
+	Addr    string // UDP ip:port clients reach the fserver at
+}
+
+// An fserver the aserver may send clients to.
+type fserverBackend struct {
+	addr     string // RPC ip:port
+	rpc      *rpcPool
+	healthy  bool
+	pending  int    // from the last health check
+	udpAddr  string // from the last health check, for tickets
+	inflight int    // GetFortuneInfo calls in progress
+}
+
+// Policy choosing the fserver for a client. Pick is called with fserverPool
+// locked and returns nil when no backend is healthy.
+type fserverPolicy interface {
+	Pick(clientAddr string, backends []*fserverBackend) *fserverBackend
+}
+
+// Hands out healthy backends in turn.
+type roundRobinPolicy struct {
+	next int
+}
+
+func (p *roundRobinPolicy) Pick(clientAddr string, backends []*fserverBackend) *fserverBackend {
+	for i := 0; i < len(backends); i++ {
+		b := backends[(p.next+i)%len(backends)]
+		if b.healthy {
+			p.next = (p.next + i + 1) % len(backends)
+			return b
+		}
+	}
+	return nil
+}
+
+// Picks the healthy backend with the fewest outstanding nonces and calls.
+type leastLoadedPolicy struct{}
+
+func (p *leastLoadedPolicy) Pick(clientAddr string, backends []*fserverBackend) *fserverBackend {
+	var best *fserverBackend
+	for _, b := range backends {
+		if b.healthy && (best == nil || b.pending+b.inflight < best.pending+best.inflight) {
+			best = b
+		}
+	}
+	return best
+}
+
+// Maps client addresses onto a hash ring of backends, so a client keeps its
+// fserver while the pool is stable; an unhealthy backend's clients move to
+// the next backend on the ring.
+type consistentHashPolicy struct {
+	ring []ringPoint // sorted by hash
+}
+
+type ringPoint struct {
+	hash    uint32
+	backend *fserverBackend
+}
+
+// points per backend, spreads clients evenly over a small pool
+const ringReplicas = 100
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func newConsistentHashPolicy(backends []*fserverBackend) *consistentHashPolicy {
+	p := &consistentHashPolicy{}
+	for _, b := range backends {
+		for i := 0; i < ringReplicas; i++ {
+			p.ring = append(p.ring, ringPoint{hashString(b.addr + "#" + strconv.Itoa(i)), b})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	return p
+}
+
+func (p *consistentHashPolicy) Pick(clientAddr string, backends []*fserverBackend) *fserverBackend {
+	h := hashString(clientAddr)
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+	for i := 0; i < len(p.ring); i++ {
+		point := p.ring[(start+i)%len(p.ring)]
+		if point.backend.healthy {
+			return point.backend
+		}
+	}
+	return nil
+}
+
+// the fservers and the policy choosing between them
+var fserverPool = struct {
+	sync.Mutex
+	backends []*fserverBackend
+	policy   fserverPolicy
+}{}
+
+// Create the backends and policy from the command line
+func initFserverPool(addrs string, policy string) error {
+	for _, addr := range strings.Split(addrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			// assume healthy until the first check says otherwise
+			fserverPool.backends = append(fserverPool.backends,
+				&fserverBackend{addr: addr, rpc: newRPCPool(addr), healthy: true})
+		}
+	}
+	if len(fserverPool.backends) == 0 {
+		return fmt.Errorf("no fserver addresses")
+	}
+
+	switch policy {
+	case "round-robin":
+		fserverPool.policy = &roundRobinPolicy{}
+	case "least-loaded":
+		fserverPool.policy = &leastLoadedPolicy{}
+	case "consistent-hash":
+		fserverPool.policy = newConsistentHashPolicy(fserverPool.backends)
+	default:
+		return fmt.Errorf("unknown fserver policy %q", policy)
+	}
+	return nil
+}
+
+// Choose an fserver for a client, counting the call as in flight
+func pickFserver(clientAddr string) *fserverBackend {
+	fserverPool.Lock()
+	defer fserverPool.Unlock()
+
+	b := fserverPool.policy.Pick(clientAddr, fserverPool.backends)
+	if b != nil {
+		b.inflight++
+	}
+	return b
+}
+
+// Finish a call to an fserver, taking it out of rotation if the call failed
+func releaseFserver(b *fserverBackend, err error) {
+	fserverPool.Lock()
+	defer fserverPool.Unlock()
+
+	b.inflight--
+	if err != nil && b.healthy {
+		log.Printf("fserver %s unhealthy: %s", b.addr, err)
+		b.healthy = false
+	}
+}
+
+// Periodically health-check every fserver
+func watchFservers(interval time.Duration) {
+	for {
+		for _, b := range fserverPool.backends {
+			var health FortuneServerHealth
+			err := b.rpc.call("FortuneServerRPC.Health", 0, &health)
+
+			fserverPool.Lock()
+			if err != nil {
+				if b.healthy {
+					log.Printf("fserver %s unhealthy: %s", b.addr, err)
+				}
+				b.healthy = false
+			} else {
+				if !b.healthy {
+					log.Printf("fserver %s healthy", b.addr)
+				}
+				b.healthy = true
+				b.pending = health.Pending
+				b.udpAddr = health.Addr
+			}
+			fserverPool.Unlock()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Persistent RPC connections
+//////////////////////////////
+
+// error for a call that got no reply within rpcTimeout
+var errRPCTimeout = errors.New("rpc call timed out")
+
+// limits on the RPC link to each fserver
+var rpcTimeout time.Duration
+var rpcMaxConns int
+var rpcMaxInflight int
+
+// TLS for the RPC link to the fservers, nil for plain TCP
+var rpcTLS *tls.Config
+
+// Returns the TLS config fservers are dialed with: the aserver's client
+// certificate, and the CA the fservers' certificates must be signed by
+func loadRPCTLS(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("%s: no CA certificate", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// Reusable RPC connections to one fserver, with latency metrics.
+type rpcPool struct {
+	addr  string
+	slots chan struct{} // bounds concurrent calls
+
+	sync.Mutex
+	clients []*rpc.Client // nil entries are dialed on use
+	next    int
+
+	calls          int64
+	failures       int64
+	totalLatency   time.Duration
+	maxLatency     time.Duration
+	latencyBuckets []int64 // calls at most each rpcLatencyBuckets bound, cumulative
+}
+
+func newRPCPool(addr string) *rpcPool {
+	return &rpcPool{
+		addr:           addr,
+		slots:          make(chan struct{}, rpcMaxInflight),
+		clients:        make([]*rpc.Client, rpcMaxConns),
+		latencyBuckets: make([]int64, len(rpcLatencyBuckets)),
+	}
+}
+
+// errors returned by the fserver itself rather than the transport
+func isServerError(err error) bool {
+	var serverErr rpc.ServerError
+	return errors.As(err, &serverErr)
+}
+
+// Take the next connection in turn, dialing it if it is not open. The dial
+// runs unlocked, so a slow fserver does not hold up other calls, record or
+// the metrics handler.
+func (p *rpcPool) get() (int, *rpc.Client, error) {
+	p.Lock()
+	i := p.next
+	p.next = (p.next + 1) % len(p.clients)
+	client := p.clients[i]
+	p.Unlock()
+	if client != nil {
+		return i, client, nil
+	}
+
+	client, err := p.dial()
+	if err != nil {
+		return i, nil, err
+	}
+
+	// another call may have filled the slot meanwhile; keep its connection
+	p.Lock()
+	defer p.Unlock()
+	if p.clients[i] != nil {
+		client.Close()
+		return i, p.clients[i], nil
+	}
+	p.clients[i] = client
+	return i, client, nil
+}
+
+// Open a connection to the fserver
+func (p *rpcPool) dial() (*rpc.Client, error) {
+	var conn net.Conn
+	var err error
+	if rpcTLS != nil {
+		// the fserver's certificate must name the address dialed
+		dialer := &net.Dialer{Timeout: rpcTimeout}
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.addr, rpcTLS)
+	} else {
+		conn, err = net.DialTimeout("tcp", p.addr, rpcTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// Close a broken connection so the next call on its slot redials
+func (p *rpcPool) discard(i int, client *rpc.Client) {
+	p.Lock()
+	if p.clients[i] == client {
+		p.clients[i] = nil
+	}
+	p.Unlock()
+	client.Close()
+}
+
+func (p *rpcPool) record(latency time.Duration, err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.calls++
+	if err != nil {
+		p.failures++
+	}
+	p.totalLatency += latency
+	if latency > p.maxLatency {
+		p.maxLatency = latency
+	}
+	for i, le := range rpcLatencyBuckets {
+		if latency.Seconds() <= le {
+			p.latencyBuckets[i]++
+		}
+	}
+}
+
+// Call an RPC method on the fserver, waiting at most rpcTimeout for the reply
+func (p *rpcPool) call(method string, args interface{}, reply interface{}) error {
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+
+	start := time.Now()
+	i, client, err := p.get()
+	if err != nil {
+		p.record(time.Since(start), err)
+		return err
+	}
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-time.After(rpcTimeout):
+		err = errRPCTimeout
+	}
+	p.record(time.Since(start), err)
+
+	if err != nil && !isServerError(err) {
+		p.discard(i, client)
+	}
+	return err
+}
+
+// Periodically log call latency to each fserver
+func logRPCStats(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, b := range fserverPool.backends {
+			p := b.rpc
+			p.Lock()
+			var avg time.Duration
+			if p.calls > 0 {
+				avg = p.totalLatency / time.Duration(p.calls)
+			}
+			log.Printf("fserver %s: %d calls, %d failed, latency avg %s max %s",
+				p.addr, p.calls, p.failures, avg, p.maxLatency)
+			p.Unlock()
+		}
+	}
+}
+
+// Messages that predate the Version field are version 1
+func messageVersion(version int) int {
+	if version < 1 {
+		return 1
+	}
+	return version
+}
+
+// A client request: who sent it and, if it came in an Envelope, the
+// envelope to answer in kind.
+type request struct {
+	clientAddr string
+	envelope   *Envelope // nil for bare messages
+	stream     net.Conn  // TCP stream the request came on, nil for UDP
+	key        []byte    // session key sealing the replies, nil for plaintext
+}
+
+// how long replies to enveloped requests are kept for retransmissions
+var replyTTL time.Duration
+
+// Replies to enveloped requests by client and request id, so that a
+// retransmitted request gets the original reply instead of being handled
+// again (and failing, since nonces are single use).
+var replyCache = struct {
+	sync.Mutex
+	m map[replyKey]*cachedReply
+}{m: make(map[replyKey]*cachedReply)}
+
+type replyKey struct {
+	clientAddr string
+	requestID  uint64
+}
+
+type cachedReply struct {
+	data     []byte // nil while the request is being handled
+	received time.Time
+}
+
+// Reports whether req was seen before, resending its reply if there is one
+// yet. Otherwise req is recorded as being handled.
+func resendReply(req request) bool {
+	key := replyKey{req.clientAddr, req.envelope.RequestID}
+	replyCache.Lock()
+	var data []byte
+	r, ok := replyCache.m[key]
+	if ok {
+		data = r.data
+	} else {
+		replyCache.m[key] = &cachedReply{received: time.Now()}
+	}
+	replyCache.Unlock()
+
+	if data != nil {
+		writeToClient(req, data)
+	}
+	return ok
+}
+
+// Forget a request dropped without a reply, so that a retransmission of it
+// is handled afresh instead of waiting on a reply that never comes
+func forgetRequest(req request) {
+	if req.envelope == nil {
+		return
+	}
+	key := replyKey{req.clientAddr, req.envelope.RequestID}
+	replyCache.Lock()
+	if r, ok := replyCache.m[key]; ok && r.data == nil {
+		delete(replyCache.m, key)
+	}
+	replyCache.Unlock()
+}
+
+// Remove replies older than replyTTL
+func expireReplies() {
+	for range time.Tick(replyTTL / 2) {
+		replyCache.Lock()
+		for key, r := range replyCache.m {
+			if time.Since(r.received) > replyTTL {
+				delete(replyCache.m, key)
+			}
+		}
+		replyCache.Unlock()
+	}
+}
+
+// Send a message of the given type to the client, wrapped in an Envelope if
+// the request was
+func sendMessage(req request, msgType string, msg interface{}) {
+	// encoding msg to JSON to aserver
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("client %s: encoding %s: %s", req.clientAddr, msgType, err)
+		return
+	}
+
+	if req.envelope != nil {
+		env := Envelope{
+			Type:      msgType,
+			Version:   envelopeVersion,
+			RequestID: req.envelope.RequestID,
+			Payload:   jsonMsg,
+		}
+		if req.key != nil {
+			env, err = sealEnvelope(req.key, env)
+		}
+		if err == nil {
+			jsonMsg, err = json.Marshal(env)
+		}
+		if err != nil {
+			log.Printf("client %s: encoding %s envelope: %s", req.clientAddr, msgType, err)
+			return
+		}
+
+		key := replyKey{req.clientAddr, req.envelope.RequestID}
+		replyCache.Lock()
+		if r, ok := replyCache.m[key]; ok {
+			r.data = jsonMsg
+		}
+		replyCache.Unlock()
+	}
+
+	writeToClient(req, jsonMsg)
+
+	// only a nonce is followed by another request; closing a stream first
+	// leaves TIME_WAIT to the server, so the client can reuse its address
+	// for the fserver
+	if req.stream != nil && msgType != msgNonce {
+		req.stream.Close()
+	}
+}
+
+// Send an encoded message to the client
+func writeToClient(req request, data []byte) {
+	if req.stream != nil {
+		req.stream.SetWriteDeadline(time.Now().Add(streamIdleTimeout))
+		if err := writeFrame(req.stream, data); err != nil {
+			log.Printf("client %s: %s", req.clientAddr, err)
+		}
+		return
+	}
+
+	// client address
+	clientUdpAddr, err := net.ResolveUDPAddr("udp", req.clientAddr)
+	if err != nil {
+		log.Printf("client %s: %s", req.clientAddr, err)
+		return
+	}
+
+	// sending msg
+	_, err = conndp.WriteToUDP(data, clientUdpAddr)
+	if err != nil {
+		log.Printf("client %s: %s", req.clientAddr, err)
+	}
+}
 
-		// check if hash value matches, if not, error
-		if hash.Hash == clientHash.Hash {
+// Send an ErrMessage to the client
+func sendError(req request, text string) {
+	log.Printf("client %s: %s", req.clientAddr, text)
+	errorCounts.inc(text)
+
+	var error ErrMessage
+	error.Error = text
+	sendMessage(req, msgError, error)
+}
 
-			initiateRcpConnection(clientAddr)
-			aserverClientMD5Map.Unlock()
+func initiateRcpConnection(req request) {
+	// try healthy fservers until one answers, at most one call per backend: a
+	// failed one is skipped until its next successful health check, which may
+	// come before the next pick
+	for i := 0; i < len(fserverPool.backends); i++ {
+		backend := pickFserver(req.clientAddr)
+		if backend == nil {
+			break
+		}
 
+		// Calling fortune server over a pooled connection, handing it the
+		// session key of an encrypted session
+		var fInfoMsg FortuneInfoMessage
+		var err error
+		if req.key != nil {
+			args := SessionFortuneArgs{ClientAddr: req.clientAddr, Key: req.key}
+			err = backend.rpc.call("FortuneServerRPC.GetSessionFortuneInfo", args, &fInfoMsg)
 		} else {
-			sendUnexpectedHashValueError(clientAddr)
+			err = backend.rpc.call("FortuneServerRPC.GetFortuneInfo", req.clientAddr, &fInfoMsg)
+		}
+		releaseFserver(backend, err)
+
+		if err == nil {
+			sendMessage(req, msgFortuneInfo, fInfoMsg)
+			return
 		}
+	}
+	sendError(req, errNoFserver)
+}
+
+func processHashMessage(clientHash HashMessage, req request) {
+	clientAddr := req.clientAddr
+
+	// nonces are single use: a replayed or second guess finds no entry
+	aserverClientMD5Map.Lock()
+	c, ok := aserverClientMD5Map.m[clientAddr]
+	delete(aserverClientMD5Map.m, clientAddr)
+	aserverClientMD5Map.Unlock()
+
+	if !ok {
+		authCounts.inc("failure")
+		sendError(req, errUnknownAddress)
+		return
+	}
+	if time.Since(c.Issued) > nonceTTL {
+		authCounts.inc("failure")
+		sendError(req, errExpiredNonce)
+		return
+	}
+
+	// revoked or unknown clients have no secret
+	clientSecret, ok := lookupSecret(clientHash.ClientID)
+	if !ok {
+		authCounts.inc("failure")
+		sendError(req, errUnknownClient)
+		return
+	}
+
+	// check if hash value and protocol version match, if not, error
+	expected := computeExpectedHash(c, clientSecret)
+	if !hmac.Equal([]byte(expected), []byte(clientHash.Hash)) ||
+		c.Version != messageVersion(clientHash.Version) {
+		recordHashResult(clientAddr, false)
+		authCounts.inc("failure")
+		sendError(req, errUnexpectedHash)
+		return
+	}
+	recordHashResult(clientAddr, true)
+	authCounts.inc("success")
+
+	// the session key is derived like the version 2 hash, and sealed
+	// replies need an envelope
+	if clientHash.Encrypt {
+		if c.Version < 2 || req.envelope == nil {
+			sendError(req, errNoEncryption)
+			return
+		}
+		if ticketAlg != "" {
+			// tickets cannot carry the session key to the fserver
+			sendError(req, errTicketEncryption)
+			return
+		}
+		req.key = computeSessionKey(c.Nonce, clientSecret)
+	} else if requireEncryption {
+		sendError(req, errEncryptionRequired)
+		return
+	}
+
+	// clients that predate the envelope know nothing of tickets
+	if ticketAlg != "" && req.envelope != nil {
+		issueTicket(req)
 	} else {
-		sendUnknownAddressError(clientAddr)
+		initiateRcpConnection(req)
 	}
 }
 
-// Method for sending NonceMessage
-func sendNonceMessage(err error, clientAddr string) {
+// Method for sending NonceMessage, negotiating the auth protocol version
+func sendNonceMessage(clientVersion int, req request) {
+	clientAddr := req.clientAddr
+
+	if !admitNonceRequest(req) {
+		return
+	}
+	if shuttingDown.Load() {
+		sendError(req, errShuttingDown)
+		return
+	}
+
+	// highest version both sides speak
+	version := messageVersion(clientVersion)
+	if version > authProtocolVersion {
+		version = authProtocolVersion
+	}
+	if version < minAuthVersion {
+		sendError(req, errUnsupportedAuth)
+		return
+	}
 
-	// generate seed
-	rand.Seed(int64(time.Now().Nanosecond()))
+	// random nonce from the randomly seeded global source; reseeding it per
+	// request handed concurrent clients the same nonce
 	nonce63 := rand.Int()
 
 	// convert int to int64
@@ -195,84 +1409,578 @@ func sendNonceMessage(err error, clientAddr string) {
 	// create a NonceMessage
 	var nonce NonceMessage
 	nonce.Nonce = nonce64
+	nonce.Version = version
 
-	// encoding NonceMessage to JSON to aserver
-	jsonNonce, err := json.Marshal(nonce)
-	handleError(err)
-
-	// client address
-	clientUdpAddr, err := net.ResolveUDPAddr("udp", clientAddr)
-	handleError(err)
+	// Adding client and issued nonce to global map before the client can
+	// answer, or another worker may see its HashMessage first. Once the map
+	// is full, new clients are dropped until nonces are answered or expire.
+	aserverClientMD5Map.Lock()
+	_, reissue := aserverClientMD5Map.m[clientAddr]
+	if !reissue && len(aserverClientMD5Map.m) >= maxChallenges {
+		aserverClientMD5Map.Unlock()
+		limitStats.capped.Add(1)
+		forgetRequest(req)
+		return
+	}
+	aserverClientMD5Map.m[clientAddr] = challenge{Nonce: nonce64, Version: version, Issued: time.Now()}
+	aserverClientMD5Map.Unlock()
 
 	// sending NonceMessage
-	_, err = conndp.WriteToUDP(jsonNonce, clientUdpAddr)
-	handleError(err)
+	sendMessage(req, msgNonce, nonce)
+}
 
-	// Nonce and Secret
-	md5Hash := computeNonceSecretHash(nonce64, secret)
+// Handle packets until the queue is closed
+func worker(packets <-chan packet) {
+	for p := range packets {
+		handleClientConnection(p.buf, len(p.buf), p.clientAddr, nil)
+		inflight.Add(-1)
+	}
+}
 
-	var hash HashMessage
-	hash.Hash = md5Hash
+// TCP stream transport
+//////////////////////////////
 
-	// Adding client and HashMessage value to global map
-	aserverClientMD5Map.Lock()
-	aserverClientMD5Map.m[clientAddr] = hash
-	aserverClientMD5Map.Unlock()
+// largest frame accepted on a client stream
+const maxFrame = 1 << 20
+
+// how long a client stream may sit idle before it is closed
+const streamIdleTimeout = 30 * time.Second
+
+// Write msg to a stream as a frame: its length as a 4 byte big-endian
+// integer, then msg
+func writeFrame(w io.Writer, msg []byte) error {
+	frame := make([]byte, 4+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+	copy(frame[4:], msg)
+	_, err := w.Write(frame)
+	return err
 }
 
-func handleClientConnection(buf []byte, n int, clientAddr string) {
-	// check message, if it's a hash, process hash, if not, send nonce
+// Read a frame written by writeFrame
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n > maxFrame {
+		return nil, fmt.Errorf("frame of %d bytes is over %d", n, maxFrame)
+	}
+	msg := make([]byte, n)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+// Accept clients on TCP streams until ctx is done
+func acceptStreams(ctx context.Context, ln *net.TCPListener) {
+	// the deadline fails the Accept in progress
+	go func() {
+		<-ctx.Done()
+		ln.SetDeadline(time.Now())
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Printf("accepting client stream: %s", err)
+			continue
+		}
+		go serveStream(conn)
+	}
+	ln.Close()
+}
+
+// Handle the frames on a client stream one at a time, until the last reply
+// closes it
+func serveStream(conn net.Conn) {
+	defer conn.Close()
+	clientAddr := conn.RemoteAddr().String()
+	for {
+		conn.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+		msg, err := readFrame(conn)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("client %s: %s", clientAddr, err)
+			}
+			return
+		}
+		inflight.Add(1)
+		handleClientConnection(msg, len(msg), clientAddr, conn)
+		inflight.Add(-1)
+	}
+}
+
+// Dispatch an enveloped message on its type
+func handleEnvelope(env Envelope, req request) {
+	req.envelope = &env
+	if env.Type == msgNonceReq || env.Type == msgHash {
+		requestCounts.inc(env.Type)
+	} else {
+		requestCounts.inc("other")
+	}
+
+	// with -cookies nothing over UDP is answered, bar the cookie, or kept
+	// until the client shows it receives at its address: a nonce request
+	// must first echo a cookie, and anything else is dropped unless
+	// verifiedAddress. The cookie reply is not cached.
+	if cookies && req.stream == nil {
+		if env.Type != msgNonceReq {
+			if !verifiedAddress(req) {
+				return
+			}
+		} else {
+			var nonceReq NonceReqMessage
+			if json.Unmarshal(env.Payload, &nonceReq) != nil {
+				return
+			}
+			if !checkCookie(req.clientAddr, nonceReq.Cookie) {
+				sendMessage(req, msgCookie, CookieMessage{Cookie: makeCookie(req.clientAddr)})
+				return
+			}
+		}
+	}
+
+	if env.Version != envelopeVersion {
+		sendError(req, errUnsupportedEnvelope)
+		return
+	}
+
+	// a retransmission gets the original reply, or none if that is still
+	// being worked out
+	if resendReply(req) {
+		return
+	}
+
+	switch env.Type {
+	case msgNonceReq:
+		var nonceReq NonceReqMessage
+		if json.Unmarshal(env.Payload, &nonceReq) != nil {
+			sendError(req, errMalformed)
+			return
+		}
+		sendNonceMessage(nonceReq.Version, req)
+
+	case msgHash:
+		var hash HashMessage
+		if json.Unmarshal(env.Payload, &hash) != nil {
+			sendError(req, errMalformed)
+			return
+		}
+		processHashMessage(hash, req)
+
+	default:
+		sendError(req, errUnknownType)
+	}
+}
+
+func handleClientConnection(buf []byte, n int, clientAddr string, stream net.Conn) {
+	// a bug hit by one client's datagram only fails that request
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("client %s: panic handling %q: %v", clientAddr, buf[:n], r)
+		}
+	}()
+
+	// enveloped messages say what they are
+	var env Envelope
+	if json.Unmarshal(buf[:n], &env) == nil && env.Type != "" {
+		handleEnvelope(env, request{clientAddr: clientAddr, stream: stream})
+		return
+	}
+
+	// bare message: check message, if it's a hash, process hash, if not, send nonce
+	req := request{clientAddr: clientAddr, stream: stream}
 	var hash HashMessage
 	err := json.Unmarshal(buf[:n], &hash)
-	if err != nil {
+	if err != nil || hash.Hash == "" {
 
-		sendNonceMessage(err, clientAddr)
+		// a NonceReqMessage, or any other payload from a version 1 client;
+		// these cannot echo a cookie
+		requestCounts.inc(msgNonceReq)
+		if cookies && stream == nil {
+			return
+		}
+		var nonceReq NonceReqMessage
+		json.Unmarshal(buf[:n], &nonceReq)
+		sendNonceMessage(nonceReq.Version, req)
 
 	} else {
-		processHashMessage(hash, clientAddr)
+		// a client that cannot echo a cookie was never given a nonce
+		requestCounts.inc(msgHash)
+		if cookies && stream == nil {
+			return
+		}
+		processHashMessage(hash, req)
+	}
+}
+
+// Metrics
+//////////////////////////////
+
+// Counts by the value of a single label
+type counterVec struct {
+	sync.Mutex
+	m map[string]int64
+}
+
+func (c *counterVec) inc(value string) {
+	c.Lock()
+	if c.m == nil {
+		c.m = make(map[string]int64)
+	}
+	c.m[value]++
+	c.Unlock()
+}
+
+func (c *counterVec) get(value string) int64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.m[value]
+}
+
+func (c *counterVec) total() int64 {
+	c.Lock()
+	defer c.Unlock()
+	var n int64
+	for _, count := range c.m {
+		n += count
+	}
+	return n
+}
+
+// enveloped and bare requests by type, "other" for unknown types
+var requestCounts counterVec
+
+// HashMessages by "success" or "failure"
+var authCounts counterVec
+
+// ErrMessages sent by error text
+var errorCounts counterVec
+
+// upper bounds in seconds of the RPC latency histogram buckets
+var rpcLatencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Write the HELP and TYPE lines of a metric
+func writeMetricHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Write a counter with one sample per label value, in label order
+func writeCounterVec(w io.Writer, name string, label string, help string, c *counterVec) {
+	writeMetricHeader(w, name, "counter", help)
+	c.Lock()
+	values := make([]string, 0, len(c.m))
+	for value := range c.m {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, labelEscaper.Replace(value), c.m[value])
 	}
+	c.Unlock()
+}
+
+// Write a metric with a single unlabelled sample
+func writeMetric(w io.Writer, name string, kind string, help string, value int64) {
+	writeMetricHeader(w, name, kind, help)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+// Serve the metrics in the Prometheus text exposition format
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeCounterVec(w, "aserver_requests_total", "type", "Client requests by message type.", &requestCounts)
+	writeCounterVec(w, "aserver_auth_total", "result", "Hashes checked, by result.", &authCounts)
+	writeCounterVec(w, "aserver_errors_sent_total", "error", "ErrMessages sent to clients, by error.", &errorCounts)
+
+	writeMetric(w, "aserver_rate_limited_total", "counter",
+		"Nonce requests dropped over the per-IP rate.", limitStats.rateLimited.Load())
+	writeMetric(w, "aserver_challenges_capped_total", "counter",
+		"Nonce requests dropped while -max-challenges nonces were outstanding.", limitStats.capped.Load())
+	writeMetric(w, "aserver_locked_out_total", "counter",
+		"Nonce requests from locked out IPs.", limitStats.lockedOut.Load())
+	writeMetric(w, "aserver_lockouts_total", "counter", "Client IPs locked out.", limitStats.lockouts.Load())
+
+	// the RPC latency histogram and health of each fserver
+	writeMetricHeader(w, "aserver_rpc_duration_seconds", "histogram", "Latency of RPC calls to fservers.")
+	for _, b := range fserverPool.backends {
+		p := b.rpc
+		p.Lock()
+		for i, le := range rpcLatencyBuckets {
+			fmt.Fprintf(w, "aserver_rpc_duration_seconds_bucket{fserver=\"%s\",le=\"%g\"} %d\n",
+				p.addr, le, p.latencyBuckets[i])
+		}
+		fmt.Fprintf(w, "aserver_rpc_duration_seconds_bucket{fserver=\"%s\",le=\"+Inf\"} %d\n", p.addr, p.calls)
+		fmt.Fprintf(w, "aserver_rpc_duration_seconds_sum{fserver=\"%s\"} %g\n", p.addr, p.totalLatency.Seconds())
+		fmt.Fprintf(w, "aserver_rpc_duration_seconds_count{fserver=\"%s\"} %d\n", p.addr, p.calls)
+		p.Unlock()
+	}
+	writeMetricHeader(w, "aserver_rpc_failures_total", "counter", "Failed RPC calls to fservers.")
+	for _, b := range fserverPool.backends {
+		b.rpc.Lock()
+		fmt.Fprintf(w, "aserver_rpc_failures_total{fserver=\"%s\"} %d\n", b.addr, b.rpc.failures)
+		b.rpc.Unlock()
+	}
+	writeMetricHeader(w, "aserver_fserver_healthy", "gauge", "Whether an fserver passed its last health check.")
+	fserverPool.Lock()
+	for _, b := range fserverPool.backends {
+		healthy := 0
+		if b.healthy {
+			healthy = 1
+		}
+		fmt.Fprintf(w, "aserver_fserver_healthy{fserver=\"%s\"} %d\n", b.addr, healthy)
+	}
+	fserverPool.Unlock()
+
+	// map sizes
+	aserverClientMD5Map.RLock()
+	challenges := len(aserverClientMD5Map.m)
+	aserverClientMD5Map.RUnlock()
+	replyCache.Lock()
+	replies := len(replyCache.m)
+	replyCache.Unlock()
+	sources.Lock()
+	tracked := len(sources.m)
+	sources.Unlock()
+	writeMetric(w, "aserver_challenges", "gauge", "Nonces awaiting a HashMessage.", int64(challenges))
+	writeMetric(w, "aserver_reply_cache_entries", "gauge", "Replies kept for retransmitted requests.", int64(replies))
+	writeMetric(w, "aserver_tracked_sources", "gauge", "Client IPs tracked for rate limiting and lockout.", int64(tracked))
+}
+
+// Serve the metrics at /metrics on addr
+func serveMetricsOn(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	go func() {
+		log.Printf("metrics: %s", http.Serve(ln, mux))
+	}()
+	return nil
+}
+
+// Shutdown
+//////////////////////////////
+
+// set on SIGTERM or SIGINT: no new nonces are issued, and handshakes under
+// way get until drainTimeout to finish
+var shuttingDown atomic.Bool
+
+// requests read and not yet handled
+var inflight atomic.Int64
+
+// how long handshakes under way get on shutdown
+var drainTimeout time.Duration
+
+// how often draining checks for work left
+const drainPoll = 50 * time.Millisecond
+
+// Stop issuing nonces and wait until every nonce issued has been answered
+// or has expired and no request is being handled, or drainTimeout passes.
+// Reports whether everything finished.
+func drain() bool {
+	shuttingDown.Store(true)
+	log.Printf("shutting down, draining for up to %s", drainTimeout)
+
+	deadline := time.Now().Add(drainTimeout)
+	for time.Now().Before(deadline) {
+		aserverClientMD5Map.RLock()
+		challenges := len(aserverClientMD5Map.m)
+		aserverClientMD5Map.RUnlock()
+		if challenges == 0 && inflight.Load() == 0 {
+			return true
+		}
+		time.Sleep(drainPoll)
+	}
+	return false
+}
+
+// Log what the aserver did and what it left unfinished
+func logShutdown(drained bool) {
+	aserverClientMD5Map.RLock()
+	challenges := len(aserverClientMD5Map.m)
+	aserverClientMD5Map.RUnlock()
+
+	status := "drained"
+	if !drained {
+		status = "drain deadline passed"
+	}
+	log.Printf("aserver stopped, %s: %d requests, %d authenticated, %d rejected; "+
+		"%d nonces unanswered, %d requests unfinished",
+		status, requestCounts.total(), authCounts.get("success"), authCounts.get("failure"),
+		challenges, inflight.Load())
 }
 
 /*Usage:
-go run auth-server.go [aserver UDP ip:port] [fserver RPC ip:port] [secret]
+go run auth-server.go [flags] [aserver UDP ip:port] [fserver RPC ip:port,...] [secret]
 [aserver UDP ip:port] : the UDP address on which the aserver receives new client connections
-[fserver RPC ip:port] : the TCP address on which the fserver listens to RPC connections from the aserver
-[secret] : an int64 secret
+[fserver RPC ip:port,...] : comma-separated TCP addresses on which fservers listen to RPC connections from the aserver
+[secret] : an int64 secret shared by clients without a client id; optional
+with -credentials, in which case such clients are rejected
+Run with -h for the list of flags.
 */
 
 func main() {
 
 	// Process args.
-	if len(os.Args) != 4 {
+	flag.IntVar(&minAuthVersion, "min-auth-version", 1,
+		"lowest auth protocol version accepted; 2 rejects MD5 clients")
+	flag.StringVar(&credentials.path, "credentials", "",
+		"file of \"client-id secret\" lines, one per client")
+	flag.DurationVar(&nonceTTL, "nonce-ttl", 30*time.Second,
+		"how long a client has to answer a nonce")
+	flag.DurationVar(&replyTTL, "reply-ttl", 30*time.Second,
+		"how long replies are kept to answer retransmitted requests")
+	flag.BoolVar(&requireEncryption, "require-encryption", false,
+		"reject clients that do not ask for an encrypted session")
+	ticketKey := flag.String("ticket-key", "",
+		"key file signing fortune tickets, which replace the GetFortuneInfo call")
+	ticketAlgName := flag.String("ticket-alg", "hmac", "ticket signature: hmac or ed25519")
+	flag.DurationVar(&ticketTTL, "ticket-ttl", 30*time.Second, "how long a fortune ticket is valid")
+	flag.Float64Var(&nonceRate, "rate", 0,
+		"nonce requests allowed per second from one client IP (0 disables the limit)")
+	flag.IntVar(&nonceBurst, "burst", 0, "nonce requests allowed in a burst from one client IP, with -rate")
+	flag.IntVar(&maxChallenges, "max-challenges", 10000,
+		"most nonces awaiting a hash; further nonce requests are dropped")
+	flag.IntVar(&lockoutFailures, "lockout-failures", 0,
+		"unexpected hashes in a row that lock a client IP out (0 disables lockout)")
+	flag.DurationVar(&lockoutPeriod, "lockout", 0, "how long a client IP is locked out, with -lockout-failures")
+	flag.BoolVar(&cookies, "cookies", false,
+		"answer UDP nonce requests with a cookie the client must echo before a nonce is issued")
+	flag.DurationVar(&cookieTTL, "cookie-ttl", 10*time.Second, "how long a cookie can be echoed")
+	flag.DurationVar(&drainTimeout, "drain", 10*time.Second,
+		"how long handshakes under way get to finish on SIGTERM")
+	limitStatsInterval := flag.Duration("limit-stats", 0,
+		"how often to log rate limiting and lockout counters (0 disables)")
+	metricsAddr := flag.String("metrics", "",
+		"ip:port serving Prometheus metrics at /metrics, e.g. 127.0.0.1:9100 (none by default)")
+	credentialsReload := flag.Duration("credentials-reload", 5*time.Second,
+		"how often to check the credentials file for changes")
+	fserverPolicyName := flag.String("fserver-policy", "round-robin",
+		"how clients are spread over fservers: round-robin, least-loaded or consistent-hash")
+	healthInterval := flag.Duration("health-interval", 2*time.Second,
+		"how often fservers are health-checked")
+	flag.DurationVar(&rpcTimeout, "rpc-timeout", 2*time.Second,
+		"longest wait for an fserver to accept a connection or answer a call")
+	flag.IntVar(&rpcMaxConns, "rpc-conns", 2, "connections kept open to each fserver")
+	flag.IntVar(&rpcMaxInflight, "rpc-max-inflight", 64,
+		"most concurrent calls to each fserver, further calls wait")
+	tlsCA := flag.String("tls-ca", "", "CA certificate the fservers' certificates must be signed by")
+	tlsCert := flag.String("tls-cert", "", "client certificate presented to the fservers")
+	tlsKey := flag.String("tls-key", "", "key of the -tls-cert certificate")
+	rpcStats := flag.Duration("rpc-stats", 0,
+		"how often to log RPC call latency to each fserver (0 disables)")
+	workers := flag.Int("workers", 16, "goroutines handling client datagrams")
+	tcpClients := flag.Bool("tcp", false,
+		"also serve clients over TCP at the same address, messages framed by a 4 byte length")
+	queueSize := flag.Int("queue", 256,
+		"datagrams waiting for a worker before reads block")
+	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr,
-			"Usage: %s [aserver UDP ip:port] [fserver RPC ip:port] [secret]\n",
+			"Usage: %s [flags] [aserver UDP ip:port] [fserver RPC ip:port,...] [secret]\n",
 			os.Args[0])
-		os.Exit(1)
+		flag.PrintDefaults()
 	}
+	flag.Parse()
 
-	msg := make([]byte, 1024)
+	if flag.NArg() != 3 && (flag.NArg() != 2 || credentials.path == "") {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *credentialsReload <= 0 || nonceTTL <= 0 || replyTTL <= 0 || ticketTTL <= 0 || *healthInterval <= 0 ||
+		rpcTimeout <= 0 || rpcMaxConns <= 0 || rpcMaxInflight <= 0 || *rpcStats < 0 ||
+		*workers <= 0 || *queueSize < 0 || nonceRate < 0 || nonceBurst < 0 || maxChallenges <= 0 ||
+		lockoutFailures < 0 || lockoutPeriod < 0 || *limitStatsInterval < 0 ||
+		cookieTTL <= 0 || drainTimeout < 0 {
+		fmt.Fprintln(os.Stderr, "durations and limits must be positive")
+		os.Exit(1)
+	}
+	if nonceRate > 0 && nonceBurst == 0 {
+		fmt.Fprintln(os.Stderr, "rate needs a burst")
+		os.Exit(1)
+	}
+	if lockoutFailures > 0 && lockoutPeriod == 0 {
+		fmt.Fprintln(os.Stderr, "lockout-failures needs a lockout period")
+		os.Exit(1)
+	}
+	if minAuthVersion < 1 || minAuthVersion > authProtocolVersion {
+		fmt.Fprintf(os.Stderr, "min-auth-version must be between 1 and %d\n", authProtocolVersion)
+		os.Exit(1)
+	}
 
 	//fmt.Println("Setup addresses")
 
 	// the UDP address on which the aserver receives client connections
-	aserver := os.Args[1]
+	aserver := flag.Arg(0)
 	aserverUdpAddrG = aserver
 	aserverUdpAddr, err := net.ResolveUDPAddr("udp", aserver)
 	handleError(err)
 
-	// the TCP address on which the fserver listens to RPC connections from the aserver
-	fserver := os.Args[2]
-	fserverG = fserver
+	// TLS with a client certificate on the RPC link, all or nothing
+	if *tlsCA != "" || *tlsCert != "" || *tlsKey != "" {
+		if *tlsCA == "" || *tlsCert == "" || *tlsKey == "" {
+			fmt.Fprintln(os.Stderr, "tls-ca, tls-cert and tls-key go together")
+			os.Exit(1)
+		}
+		rpcTLS, err = loadRPCTLS(*tlsCA, *tlsCert, *tlsKey)
+		handleError(err)
+	}
 
-	// agreed upon secret
-	secretArg, err := strconv.ParseInt(os.Args[3], 10, 64)
+	// address cookies
+	if cookies {
+		cookieKey = make([]byte, 32)
+		_, err = crand.Read(cookieKey)
+		handleError(err)
+	}
+
+	// ticket mode
+	if *ticketKey != "" {
+		if requireEncryption {
+			fmt.Fprintln(os.Stderr, "require-encryption does not work with tickets")
+			os.Exit(1)
+		}
+		err = loadTicketKey(*ticketAlgName, *ticketKey)
+		handleError(err)
+	}
+
+	// the TCP addresses on which the fservers listen to RPC connections from the aserver
+	fserver := flag.Arg(1)
+	err = initFserverPool(fserver, *fserverPolicyName)
 	handleError(err)
 
-	// assign global secret variable
-	secret = secretArg
+	// agreed upon secret
+	if flag.NArg() == 3 {
+		secretArg, err := strconv.ParseInt(flag.Arg(2), 10, 64)
+		handleError(err)
+
+		// assign global secret variable
+		secret = secretArg
+		hasSharedSecret = true
+	}
+
+	// per-client secrets
+	if credentials.path != "" {
+		err = loadCredentials()
+		handleError(err)
+		go watchCredentials(*credentialsReload)
+	}
 
 	// Debug to see input from command line args
-	fmt.Printf("aserver listening on %s\nSecret: %d\n", aserver, secretArg)
+	fmt.Printf("aserver listening on %s\n", aserver)
+	if hasSharedSecret {
+		fmt.Printf("Secret: %d\n", secret)
+	}
+	if credentials.path != "" {
+		fmt.Printf("Credentials: %s (%d clients)\n", credentials.path, len(credentials.m))
+	}
 
 	conn, err := net.ListenUDP("udp", aserverUdpAddr)
 	handleError(err)
@@ -280,13 +1988,68 @@ func main() {
 	// refactor to global variable
 	conndp = conn
 
+	// on SIGTERM or SIGINT, stop taking new clients and drain
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// clients on TCP streams, at the same address
+	if *tcpClients {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", aserver)
+		handleError(err)
+		ln, err := net.ListenTCP("tcp", tcpAddr)
+		handleError(err)
+		go acceptStreams(ctx, ln)
+	}
+
+	if *metricsAddr != "" {
+		err = serveMetricsOn(*metricsAddr)
+		handleError(err)
+	}
+
+	go expireChallenges()
+	if nonceRate > 0 || lockoutFailures > 0 {
+		go expireSources()
+	}
+	if *limitStatsInterval > 0 {
+		go logLimitStats(*limitStatsInterval)
+	}
+	go expireReplies()
+	go watchFservers(*healthInterval)
+	if *rpcStats > 0 {
+		go logRPCStats(*rpcStats)
+	}
+
 	defer conn.Close()
 
-	// udp client concurrency
+	// udp client concurrency: a fixed pool of workers, each datagram read
+	// into its own buffer so the next read cannot overwrite it
+	packets := make(chan packet, *queueSize)
+	for i := 0; i < *workers; i++ {
+		go worker(packets)
+	}
+
+	// clients keep being read while draining, so handshakes under way can
+	// finish; the deadline then fails the read in progress
+	drained := make(chan bool, 1)
+	go func() {
+		<-ctx.Done()
+		drained <- drain()
+		conndp.SetReadDeadline(time.Now())
+	}()
+
 	for {
 		// fmt.Println("Listen for clients")
+		msg := make([]byte, maxDatagram)
 		n, clientAddr, err := conndp.ReadFromUDP(msg)
-		handleError(err)
-		go handleClientConnection(msg[:n], n, clientAddr.String())
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			log.Printf("reading client datagram: %s", err)
+			continue
+		}
+		inflight.Add(1)
+		packets <- packet{buf: msg[:n], clientAddr: clientAddr.String()}
 	}
+	logShutdown(<-drained)
 }
@@ -0,0 +1,841 @@
+// Tests of the aserver's client protocol. handleClientConnection is called
+// directly with the address of a loopback UDP socket, which then receives the
+// replies; GetFortuneInfo is answered by a fake fserver.
+//
+// go test -race auth-server.go auth-server_test.go
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fortune nonce handed out by the fake fserver
+const fakeFortuneNonce = 2016
+
+// Stands in for the fserver's RPC service.
+type fakeFserverRPC struct{}
+
+func (f *fakeFserverRPC) GetFortuneInfo(clientAddr string, fInfoMsg *FortuneInfoMessage) error {
+	fInfoMsg.FortuneServer = "127.0.0.1:1"
+	fInfoMsg.FortuneNonce = fakeFortuneNonce
+	return nil
+}
+
+func (f *fakeFserverRPC) GetSessionFortuneInfo(args SessionFortuneArgs, fInfoMsg *FortuneInfoMessage) error {
+	return f.GetFortuneInfo(args.ClientAddr, fInfoMsg)
+}
+
+func (f *fakeFserverRPC) Health(unused int, health *FortuneServerHealth) error {
+	health.Addr = "127.0.0.1:1"
+	return nil
+}
+
+// Reset the aserver for a test: the shared secret 42, no limits, and a fake
+// fserver
+func setupAserver(t testing.TB) {
+	secret, hasSharedSecret = 42, true
+	credentials.path = ""
+	minAuthVersion = 1
+	nonceTTL, replyTTL = 30*time.Second, 30*time.Second
+	requireEncryption, cookies, ticketAlg = false, false, ""
+	cookieTTL, cookieKey = time.Minute, bytes.Repeat([]byte{7}, 32)
+	nonceRate, nonceBurst, maxChallenges = 0, 0, 10000
+	lockoutFailures, lockoutPeriod = 0, 0
+	rpcTimeout, rpcMaxConns, rpcMaxInflight = 2*time.Second, 2, 64
+
+	aserverClientMD5Map.m = make(map[string]challenge)
+	replyCache.m = make(map[replyKey]*cachedReply)
+	sources.m = make(map[string]*source)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conndp = conn
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("FortuneServerRPC", &fakeFserverRPC{}); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go server.Accept(ln)
+
+	fserverPool.backends = nil
+	if err := initFserverPool(ln.Addr().String(), "round-robin"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A client socket the aserver replies to.
+type testClient struct {
+	t    testing.TB
+	conn *net.UDPConn
+	id   uint64
+
+	// queue of a worker pool, nil to call handleClientConnection directly
+	packets chan<- packet
+}
+
+func newTestClient(t testing.TB) *testClient {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn}
+}
+
+func (c *testClient) addr() string {
+	return c.conn.LocalAddr().String()
+}
+
+// Hand a datagram from the client to the aserver
+func (c *testClient) send(data []byte) {
+	if c.packets != nil {
+		inflight.Add(1)
+		c.packets <- packet{buf: data, clientAddr: c.addr()}
+		return
+	}
+	handleClientConnection(data, len(data), c.addr(), nil)
+}
+
+// Send msg as a bare message, returning the bare reply
+func (c *testClient) sendBare(msg interface{}) []byte {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.send(data)
+	return c.reply()
+}
+
+// Send msg in an envelope with the given request id
+func (c *testClient) sendEnvelope(id uint64, msgType string, msg interface{}) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	data, err := json.Marshal(Envelope{Type: msgType, Version: envelopeVersion, RequestID: id, Payload: payload})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.send(data)
+}
+
+// Send msg in an envelope with a new request id, returning the reply
+func (c *testClient) request(msgType string, msg interface{}) Envelope {
+	c.id++
+	c.sendEnvelope(c.id, msgType, msg)
+	return c.envelope()
+}
+
+// The next reply
+func (c *testClient) read() ([]byte, error) {
+	buf := make([]byte, maxDatagram)
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := c.conn.Read(buf)
+	return buf[:n], err
+}
+
+// The next reply, failing the test if none comes
+func (c *testClient) reply() []byte {
+	c.t.Helper()
+	data, err := c.read()
+	if err != nil {
+		c.t.Fatalf("no reply: %s", err)
+	}
+	return data
+}
+
+// The next reply, which must be an envelope
+func (c *testClient) envelope() Envelope {
+	c.t.Helper()
+	var env Envelope
+	if err := json.Unmarshal(c.reply(), &env); err != nil {
+		c.t.Fatalf("reply is not an envelope: %s", err)
+	}
+	return env
+}
+
+// Send msg in an envelope with the given request id, returning the reply of
+// type msgType. Unlike request it does not fail the test, so it can be used
+// off the test goroutine.
+func (c *testClient) try(id uint64, msgType string, msg interface{}, replyType string) (Envelope, error) {
+	c.sendEnvelope(id, msgType, msg)
+	data, err := c.read()
+	if err != nil {
+		return Envelope{}, fmt.Errorf("client %s: no %s reply: %s", c.addr(), replyType, err)
+	}
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil || env.Type != replyType {
+		return env, fmt.Errorf("client %s: got %s, want %s", c.addr(), data, replyType)
+	}
+	return env, nil
+}
+
+// Fail the test if a reply comes
+func (c *testClient) noReply() {
+	c.t.Helper()
+	buf := make([]byte, maxDatagram)
+	c.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := c.conn.Read(buf); err == nil {
+		c.t.Fatalf("unexpected reply %s", buf[:n])
+	}
+}
+
+// Decode the payload of env, which must be of type msgType
+func decodePayload(t testing.TB, env Envelope, msgType string, msg interface{}) {
+	t.Helper()
+	if env.Type != msgType {
+		t.Fatalf("got %s reply %s, want %s", env.Type, env.Payload, msgType)
+	}
+	if err := json.Unmarshal(env.Payload, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Fail the test unless env is an ErrMessage with the given text
+func expectError(t testing.TB, env Envelope, text string) {
+	t.Helper()
+	var errMessage ErrMessage
+	decodePayload(t, env, msgError, &errMessage)
+	if errMessage.Error != text {
+		t.Fatalf("got error %q, want %q", errMessage.Error, text)
+	}
+}
+
+// Counts the panics handleClientConnection recovers from, which it logs
+type panicCounter struct {
+	n atomic.Int64
+}
+
+func (p *panicCounter) Write(b []byte) (int, error) {
+	if bytes.Contains(b, []byte("panic handling")) {
+		p.n.Add(1)
+	}
+	return len(b), nil
+}
+
+// Send the log to a panicCounter for the rest of the test
+func countPanics(t testing.TB) *panicCounter {
+	p := &panicCounter{}
+	log.SetOutput(p)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return p
+}
+
+// Fail the test if a handler left shared state locked. A leaked lock is
+// replaced, so that the inputs after it still run.
+func checkUnlocked(t testing.TB) {
+	t.Helper()
+	if aserverClientMD5Map.TryLock() {
+		aserverClientMD5Map.Unlock()
+	} else {
+		aserverClientMD5Map.RWMutex = sync.RWMutex{}
+		t.Error("aserverClientMD5Map left locked")
+	}
+	if credentials.TryLock() {
+		credentials.Unlock()
+	} else {
+		credentials.RWMutex = sync.RWMutex{}
+		t.Error("credentials left locked")
+	}
+	if sources.TryLock() {
+		sources.Unlock()
+	} else {
+		sources.Mutex = sync.Mutex{}
+		t.Error("sources left locked")
+	}
+	if replyCache.TryLock() {
+		replyCache.Unlock()
+	} else {
+		replyCache.Mutex = sync.Mutex{}
+		t.Error("replyCache left locked")
+	}
+	if fserverPool.TryLock() {
+		fserverPool.Unlock()
+	} else {
+		fserverPool.Mutex = sync.Mutex{}
+		t.Error("fserverPool left locked")
+	}
+}
+
+// Run a version 2 handshake to its fortune-info reply
+func handshake(t testing.TB, c *testClient) Envelope {
+	t.Helper()
+	var nonce NonceMessage
+	decodePayload(t, c.request(msgNonceReq, NonceReqMessage{Version: 2}), msgNonce, &nonce)
+	return c.request(msgHash, HashMessage{Hash: computeNonceHMAC(nonce.Nonce, secret), Version: 2})
+}
+
+// Both hash encodings, pinned so that client and aserver agree (p1 pins the
+// same values)
+func TestHashEncodings(t *testing.T) {
+	cases := []struct {
+		nonce, secret int64
+		md5, hmac     string
+	}{
+		{2016, 42, "77d81d10067374492e42233468c778b3",
+			"7c86c07579f56dea462315e6cb42fc3e9292d6d1d0b17129ccdb1dd0a0ab0572"},
+		{-5, 3, "8666683506aacd900bbd5a74ac4edf68",
+			"be1df2193821a84486f6caa24d36222f8b522337ec2d27caf39aa97d3af52148"},
+		{9223372036854775807, 1, "f2802cd26b5c7c75c96016023bed5279",
+			"6a19a3e1bfa46fba4eccdc503d0f07d572aead8df8e764c93a17f861ae04872e"},
+	}
+	for _, c := range cases {
+		if got := computeNonceSecretHash(c.nonce, c.secret); got != c.md5 {
+			t.Errorf("MD5 hash of %d, %d = %s, want %s", c.nonce, c.secret, got, c.md5)
+		}
+		if got := computeNonceHMAC(c.nonce, c.secret); got != c.hmac {
+			t.Errorf("HMAC of %d, %d = %s, want %s", c.nonce, c.secret, got, c.hmac)
+		}
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	cases := []struct {
+		name       string
+		minVersion int
+		request    []byte // bare, or an envelope
+		version    int    // negotiated, 0 for an error
+	}{
+		{"version 1 payload", 1, []byte("ping"), 1},
+		{"bare version 2", 1, []byte(`{"Version":2}`), 2},
+		{"envelope version 2", 1, []byte(`{"Type":"nonce-req","Version":1,"Payload":{"Version":2}}`), 2},
+		{"newer than the server", 1, []byte(`{"Type":"nonce-req","Version":1,"Payload":{"Version":7}}`), 2},
+		{"envelope without a version", 1, []byte(`{"Type":"nonce-req","Version":1,"Payload":{}}`), 1},
+		{"min version 2, version 1 payload", 2, []byte("ping"), 0},
+		{"min version 2, envelope version 1", 2, []byte(`{"Type":"nonce-req","Version":1,"Payload":{"Version":1}}`), 0},
+		{"min version 2, version 2", 2, []byte(`{"Version":2}`), 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			setupAserver(t)
+			minAuthVersion = tc.minVersion
+			c := newTestClient(t)
+			c.send(tc.request)
+			reply := c.reply()
+
+			// bare requests get bare replies
+			var env Envelope
+			if json.Unmarshal(reply, &env) == nil && env.Type != "" {
+				reply = env.Payload
+			}
+			var nonce NonceMessage
+			var errMessage ErrMessage
+			json.Unmarshal(reply, &nonce)
+			json.Unmarshal(reply, &errMessage)
+
+			if tc.version == 0 {
+				if errMessage.Error != errUnsupportedAuth {
+					t.Fatalf("got %s, want %q", reply, errUnsupportedAuth)
+				}
+				if len(aserverClientMD5Map.m) != 0 {
+					t.Fatal("a rejected client was issued a nonce")
+				}
+				return
+			}
+			if errMessage.Error != "" || messageVersion(nonce.Version) != tc.version {
+				t.Fatalf("got %s, want version %d", reply, tc.version)
+			}
+		})
+	}
+}
+
+func TestHandshakeVersions(t *testing.T) {
+	t.Run("version 1", func(t *testing.T) {
+		setupAserver(t)
+		c := newTestClient(t)
+		c.send([]byte("ping"))
+		var nonce NonceMessage
+		json.Unmarshal(c.reply(), &nonce)
+
+		var fInfo FortuneInfoMessage
+		json.Unmarshal(c.sendBare(HashMessage{Hash: computeNonceSecretHash(nonce.Nonce, secret)}), &fInfo)
+		if fInfo.FortuneNonce != fakeFortuneNonce {
+			t.Fatalf("got %+v, want the fake fserver's fortune info", fInfo)
+		}
+	})
+
+	t.Run("version 2", func(t *testing.T) {
+		setupAserver(t)
+		var fInfo FortuneInfoMessage
+		decodePayload(t, handshake(t, newTestClient(t)), msgFortuneInfo, &fInfo)
+		if fInfo.FortuneNonce != fakeFortuneNonce {
+			t.Fatalf("got %+v, want the fake fserver's fortune info", fInfo)
+		}
+	})
+
+	// a hash of the other version does not match, even if it is correct
+	t.Run("MD5 for a version 2 nonce", func(t *testing.T) {
+		setupAserver(t)
+		c := newTestClient(t)
+		var nonce NonceMessage
+		decodePayload(t, c.request(msgNonceReq, NonceReqMessage{Version: 2}), msgNonce, &nonce)
+		reply := c.request(msgHash, HashMessage{Hash: computeNonceSecretHash(nonce.Nonce, secret), Version: 1})
+		expectError(t, reply, errUnexpectedHash)
+	})
+
+	t.Run("HMAC for a version 1 nonce", func(t *testing.T) {
+		setupAserver(t)
+		c := newTestClient(t)
+		var nonce NonceMessage
+		decodePayload(t, c.request(msgNonceReq, NonceReqMessage{Version: 1}), msgNonce, &nonce)
+		reply := c.request(msgHash, HashMessage{Hash: computeNonceHMAC(nonce.Nonce, secret), Version: 2})
+		expectError(t, reply, errUnexpectedHash)
+	})
+}
+
+// Frames of any size up to maxFrame come back as written, one at a time
+func TestFrameRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, 1023, 1024, 1025, 64 << 10, maxFrame}
+	var stream bytes.Buffer
+	for i, n := range sizes {
+		if err := writeFrame(&stream, bytes.Repeat([]byte{byte(i)}, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, n := range sizes {
+		msg, err := readFrame(&stream)
+		if err != nil || !bytes.Equal(msg, bytes.Repeat([]byte{byte(i)}, n)) {
+			t.Fatalf("frame %d: read %d bytes, %v; want %d", i, len(msg), err, n)
+		}
+	}
+	if _, err := readFrame(&stream); err != io.EOF {
+		t.Fatalf("got %v at the end of the stream, want EOF", err)
+	}
+}
+
+// Oversize and cut short frames are errors
+func TestBadFrames(t *testing.T) {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], maxFrame+1)
+	if _, err := readFrame(bytes.NewReader(header[:])); err == nil {
+		t.Error("frame over maxFrame read")
+	}
+	if _, err := readFrame(bytes.NewReader(header[:2])); err != io.ErrUnexpectedEOF {
+		t.Errorf("cut short header: got %v, want ErrUnexpectedEOF", err)
+	}
+
+	var stream bytes.Buffer
+	writeFrame(&stream, []byte("fortune"))
+	if _, err := readFrame(bytes.NewReader(stream.Bytes()[:stream.Len()-1])); err != io.ErrUnexpectedEOF {
+		t.Errorf("cut short frame: got %v, want ErrUnexpectedEOF", err)
+	}
+}
+
+// A nonce answers one HashMessage: a retransmission gets the original reply,
+// a replay in a new request finds no nonce
+func TestReplayedHash(t *testing.T) {
+	setupAserver(t)
+	c := newTestClient(t)
+	var nonce NonceMessage
+	decodePayload(t, c.request(msgNonceReq, NonceReqMessage{Version: 2}), msgNonce, &nonce)
+	hash := HashMessage{Hash: computeNonceHMAC(nonce.Nonce, secret), Version: 2}
+
+	first := c.request(msgHash, hash)
+	var fInfo FortuneInfoMessage
+	decodePayload(t, first, msgFortuneInfo, &fInfo)
+
+	c.sendEnvelope(c.id, msgHash, hash)
+	if again := c.envelope(); string(again.Payload) != string(first.Payload) {
+		t.Fatalf("retransmission got %s, want %s", again.Payload, first.Payload)
+	}
+
+	expectError(t, c.request(msgHash, hash), errUnknownAddress)
+
+	// from another address, too
+	expectError(t, newTestClient(t).request(msgHash, hash), errUnknownAddress)
+}
+
+// A wrong guess uses up the nonce
+func TestSecondGuess(t *testing.T) {
+	setupAserver(t)
+	c := newTestClient(t)
+	var nonce NonceMessage
+	decodePayload(t, c.request(msgNonceReq, NonceReqMessage{Version: 2}), msgNonce, &nonce)
+
+	expectError(t, c.request(msgHash, HashMessage{Hash: computeNonceHMAC(nonce.Nonce, secret+1), Version: 2}), errUnexpectedHash)
+	expectError(t, c.request(msgHash, HashMessage{Hash: computeNonceHMAC(nonce.Nonce, secret), Version: 2}), errUnknownAddress)
+}
+
+func TestExpiredNonce(t *testing.T) {
+	setupAserver(t)
+	nonceTTL = 50 * time.Millisecond
+	c := newTestClient(t)
+	var nonce NonceMessage
+	decodePayload(t, c.request(msgNonceReq, NonceReqMessage{Version: 2}), msgNonce, &nonce)
+	time.Sleep(2 * nonceTTL)
+
+	hash := HashMessage{Hash: computeNonceHMAC(nonce.Nonce, secret), Version: 2}
+	expectError(t, c.request(msgHash, hash), errExpiredNonce)
+	expectError(t, c.request(msgHash, hash), errUnknownAddress)
+
+	// a fresh nonce still works
+	var fInfo FortuneInfoMessage
+	decodePayload(t, handshake(t, c), msgFortuneInfo, &fInfo)
+}
+
+// One client's handshake through the worker pool: a wrong guess first if bad,
+// then the right hash and a retransmission of it
+func poolHandshake(c *testClient, bad bool) error {
+	c.id++
+	env, err := c.try(c.id, msgNonceReq, NonceReqMessage{Version: 2}, msgNonce)
+	if err != nil {
+		return err
+	}
+	var nonce NonceMessage
+	json.Unmarshal(env.Payload, &nonce)
+
+	if bad {
+		c.id++
+		wrong := HashMessage{Hash: computeNonceHMAC(nonce.Nonce, secret+1), Version: 2}
+		if _, err := c.try(c.id, msgHash, wrong, msgError); err != nil {
+			return err
+		}
+		c.id++
+		if env, err = c.try(c.id, msgNonceReq, NonceReqMessage{Version: 2}, msgNonce); err != nil {
+			return err
+		}
+		json.Unmarshal(env.Payload, &nonce)
+	}
+
+	c.id++
+	hash := HashMessage{Hash: computeNonceHMAC(nonce.Nonce, secret), Version: 2}
+	first, err := c.try(c.id, msgHash, hash, msgFortuneInfo)
+	if err != nil {
+		return err
+	}
+	again, err := c.try(c.id, msgHash, hash, msgFortuneInfo)
+	if err != nil {
+		return err
+	}
+	if string(again.Payload) != string(first.Payload) {
+		return fmt.Errorf("client %s: retransmission got %s, want %s", c.addr(), again.Payload, first.Payload)
+	}
+	return nil
+}
+
+// Many clients at once through the worker pool, half of them guessing wrong
+// first; run with -race
+func TestConcurrentClients(t *testing.T) {
+	setupAserver(t)
+
+	packets := make(chan packet, 16)
+	var workers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			worker(packets)
+		}()
+	}
+
+	const clients = 50
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		c := newTestClient(t)
+		c.packets = packets
+		go func(bad bool) {
+			errs <- poolHandshake(c, bad)
+		}(i%2 == 1)
+	}
+	for i := 0; i < clients; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	close(packets)
+	workers.Wait()
+
+	if n := inflight.Load(); n != 0 {
+		t.Errorf("%d datagrams still in flight", n)
+	}
+	checkUnlocked(t)
+	if n := len(aserverClientMD5Map.m); n != 0 {
+		t.Errorf("%d nonces left unanswered", n)
+	}
+}
+
+// Malformed datagrams must neither panic nor leave a lock held. The client
+// holds a challenge for nonce 2016, of version 2 for inputs of odd length,
+// and cookies are required for every other pair of lengths.
+func FuzzAserverDatagram(f *testing.F) {
+	setupAserver(f)
+	clientAddr := newTestClient(f).addr()
+	panics := countPanics(f)
+
+	seeds := [][]byte{
+		nil,
+		[]byte("ping"),
+		[]byte("{}"),
+		[]byte("null"),
+		[]byte("[]"),
+		[]byte(`{"Version":2}`),
+		[]byte(`{"Version":-1}`),
+		[]byte(`{"Version":9223372036854775807}`),
+		[]byte(`{"Cookie":"1.00"}`),
+		[]byte(`{"Hash":""}`),
+		[]byte(`{"Hash":"77d81d10067374492e42233468c778b3","ClientID":"nobody"}`),
+		[]byte(`{"Hash":"x","Version":2,"Encrypt":true}`),
+		[]byte(`{"Type":"nonce-req","Version":1,"Payload":null}`),
+		[]byte(`{"Type":"nonce-req","Version":1,"Payload":{"Version":2,"Cookie":"."}}`),
+		[]byte(`{"Type":"nonce-req","Version":1,"Payload":{"Cookie":"99999999999.abc"}}`),
+		[]byte(`{"Type":"nonce-req","Version":2,"Payload":{}}`),
+		[]byte(`{"Type":"hash","Version":1,"Payload":[1]}`),
+		[]byte(`{"Type":"hash","Version":1,"RequestID":18446744073709551615,"Payload":{"Hash":"","Version":2}}`),
+		[]byte(`{"Type":"hash","Version":1,"Payload":{"Hash":"7c86c07579f56dea462315e6cb42fc3e9292d6d1d0b17129ccdb1dd0a0ab0572","Version":2}}`),
+		[]byte(`{"Type":"sealed","Version":1,"Payload":{}}`),
+		[]byte(`{"Type":"fortune-req","Version":1,"Payload":{}}`),
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		aserverClientMD5Map.m = map[string]challenge{
+			clientAddr: {Nonce: 2016, Version: 1 + len(data)%2, Issued: time.Now()},
+		}
+		replyCache.m = make(map[replyKey]*cachedReply)
+		sources.m = make(map[string]*source)
+		cookies = len(data)%4 >= 2
+
+		before := panics.n.Load()
+		handleClientConnection(data, len(data), clientAddr, nil)
+		if panics.n.Load() != before {
+			t.Errorf("panic handling %q", data)
+		}
+		checkUnlocked(t)
+	})
+}
+
+// A nonce request dropped over the rate leaves nothing behind, so its
+// retransmission gets a nonce once a token is back
+func TestRateLimitedRetransmission(t *testing.T) {
+	setupAserver(t)
+	nonceRate, nonceBurst = 10, 1
+	c := newTestClient(t)
+
+	var nonce NonceMessage
+	decodePayload(t, c.request(msgNonceReq, NonceReqMessage{Version: 2}), msgNonce, &nonce)
+
+	c.id++
+	c.sendEnvelope(c.id, msgNonceReq, NonceReqMessage{Version: 2})
+	c.noReply()
+
+	// noReply waited two refills
+	c.sendEnvelope(c.id, msgNonceReq, NonceReqMessage{Version: 2})
+	decodePayload(t, c.envelope(), msgNonce, &nonce)
+}
+
+// Off by default, lockout is kept for the client IP, so it shuts out its
+// other ports too
+func TestLockout(t *testing.T) {
+	setupAserver(t)
+	c := newTestClient(t)
+	wrong := func(c *testClient) {
+		var nonce NonceMessage
+		decodePayload(t, c.request(msgNonceReq, NonceReqMessage{Version: 2}), msgNonce, &nonce)
+		hash := HashMessage{Hash: computeNonceHMAC(nonce.Nonce, secret+1), Version: 2}
+		expectError(t, c.request(msgHash, hash), errUnexpectedHash)
+	}
+	for i := 0; i < 10; i++ {
+		wrong(c)
+	}
+	if len(sources.m) != 0 {
+		t.Fatalf("tracking %d client IPs with the limits off", len(sources.m))
+	}
+
+	lockoutFailures, lockoutPeriod = 2, time.Minute
+	wrong(c)
+	wrong(c)
+	expectError(t, c.request(msgNonceReq, NonceReqMessage{Version: 2}), errLockedOut)
+	expectError(t, newTestClient(t).request(msgNonceReq, NonceReqMessage{Version: 2}), errLockedOut)
+}
+
+// Likewise a nonce request dropped while every challenge is taken
+func TestCappedRetransmission(t *testing.T) {
+	setupAserver(t)
+	maxChallenges = 1
+	first, second := newTestClient(t), newTestClient(t)
+
+	var nonce NonceMessage
+	decodePayload(t, first.request(msgNonceReq, NonceReqMessage{Version: 2}), msgNonce, &nonce)
+
+	second.id++
+	second.sendEnvelope(second.id, msgNonceReq, NonceReqMessage{Version: 2})
+	second.noReply()
+
+	var fInfo FortuneInfoMessage
+	hash := HashMessage{Hash: computeNonceHMAC(nonce.Nonce, secret), Version: 2}
+	decodePayload(t, first.request(msgHash, hash), msgFortuneInfo, &fInfo)
+
+	second.sendEnvelope(second.id, msgNonceReq, NonceReqMessage{Version: 2})
+	decodePayload(t, second.envelope(), msgNonce, &nonce)
+}
+
+// With cookies, an address that has not echoed one gets nothing but the
+// cookie, and leaves nothing behind
+func TestCookieGate(t *testing.T) {
+	setupAserver(t)
+	cookies = true
+	c := newTestClient(t)
+
+	unverified := [][]byte{
+		[]byte("ping"),
+		[]byte(`{"Version":2}`),
+		[]byte(`{"Hash":"77d81d10067374492e42233468c778b3"}`),
+		[]byte(`{"Type":"nonce-req","Version":1,"RequestID":1,"Payload":[]}`),
+		[]byte(`{"Type":"hash","Version":1,"RequestID":2,"Payload":{"Hash":"x"}}`),
+		[]byte(`{"Type":"hash","Version":2,"RequestID":3,"Payload":{"Hash":"x"}}`),
+		[]byte(`{"Type":"bogus","Version":1,"RequestID":4,"Payload":{}}`),
+	}
+	for _, data := range unverified {
+		c.send(data)
+		c.noReply()
+	}
+
+	// the cookie reply is stateless
+	var cookie CookieMessage
+	decodePayload(t, c.request(msgNonceReq, NonceReqMessage{Version: 2}), msgCookie, &cookie)
+	if len(replyCache.m) != 0 || len(aserverClientMD5Map.m) != 0 || len(sources.m) != 0 {
+		t.Fatalf("unverified client left %d replies, %d nonces, %d sources",
+			len(replyCache.m), len(aserverClientMD5Map.m), len(sources.m))
+	}
+
+	// holding a nonce, the client is answered
+	var nonce NonceMessage
+	decodePayload(t, c.request(msgNonceReq, NonceReqMessage{Version: 2, Cookie: cookie.Cookie}), msgNonce, &nonce)
+	expectError(t, c.request("bogus", struct{}{}), errUnknownType)
+
+	hash := HashMessage{Hash: computeNonceHMAC(nonce.Nonce, secret), Version: 2}
+	first := c.request(msgHash, hash)
+	var fInfo FortuneInfoMessage
+	decodePayload(t, first, msgFortuneInfo, &fInfo)
+
+	// and its retransmission gets the cached reply, though the nonce is
+	// gone; a replay is dropped
+	c.sendEnvelope(c.id, msgHash, hash)
+	if again := c.envelope(); string(again.Payload) != string(first.Payload) {
+		t.Fatalf("retransmission got %s, want %s", again.Payload, first.Payload)
+	}
+	c.id++
+	c.sendEnvelope(c.id, msgHash, hash)
+	c.noReply()
+}
+
+// An fserver that passes its health checks but fails every fortune request
+type brokenFserverRPC struct {
+	fakeFserverRPC
+	calls atomic.Int64
+}
+
+func (f *brokenFserverRPC) GetFortuneInfo(clientAddr string, fInfoMsg *FortuneInfoMessage) error {
+	f.calls.Add(1)
+	return fmt.Errorf("no fortunes")
+}
+
+// Picks the first backend as though a health check had just passed, giving
+// up after limit picks so that an unbounded retry still ends
+type recoveringPolicy struct {
+	picks, limit int
+}
+
+func (p *recoveringPolicy) Pick(clientAddr string, backends []*fserverBackend) *fserverBackend {
+	if p.picks++; p.picks > p.limit {
+		return nil
+	}
+	return backends[0]
+}
+
+// A request tries each fserver once, even one whose health checks keep
+// putting it back in rotation
+func TestBrokenFserver(t *testing.T) {
+	setupAserver(t)
+	broken := &brokenFserverRPC{}
+	server := rpc.NewServer()
+	if err := server.RegisterName("FortuneServerRPC", broken); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go server.Accept(ln)
+
+	fserverPool.backends = nil
+	if err := initFserverPool(ln.Addr().String(), "round-robin"); err != nil {
+		t.Fatal(err)
+	}
+	fserverPool.policy = &recoveringPolicy{limit: 10}
+
+	expectError(t, handshake(t, newTestClient(t)), errNoFserver)
+	if n := broken.calls.Load(); n != 1 {
+		t.Fatalf("fserver called %d times, want 1", n)
+	}
+}
+
+// A dial stuck in its TLS handshake leaves the pool unlocked for other calls
+// and the stats
+func TestDialUnlocked(t *testing.T) {
+	setupAserver(t)
+	rpcTLS, rpcTimeout = &tls.Config{ServerName: "fserver"}, 500*time.Millisecond
+	t.Cleanup(func() { rpcTLS = nil })
+
+	// accepts, but never answers the handshake
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	p := newRPCPool(ln.Addr().String())
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := p.get()
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if !p.TryLock() {
+		t.Fatal("pool locked while dialing")
+	}
+	p.Unlock()
+	p.record(time.Millisecond, nil)
+
+	if err := <-done; err == nil {
+		t.Fatal("handshake with a silent fserver succeeded")
+	}
+	if p.clients[0] != nil {
+		t.Fatal("failed dial installed a connection")
+	}
+}
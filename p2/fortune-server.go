@@ -6,14 +6,38 @@ Implements the solution to assignment 2 for UBC CS 416 2015 W2.
 package main
 
 import (
+	"container/list"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log"
 	"math/rand"
 	"net"
+	"net/http"
 	"net/rpc"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -23,25 +47,80 @@ import (
 var fserverIpPort string
 var fserverTcpG string
 
-// fortune
-var fortuneG string
+// fortunes by category; the "" category holds every fortune
+var fortunes = struct {
+	sync.Mutex
+	path       string // fortune file or directory of category files, if any
+	modTime    time.Time
+	policy     string // "random" or "round-robin"
+	byCategory map[string][]string
+	next       map[string]int // round-robin position per category
+}{byCategory: make(map[string][]string), next: make(map[string]int)}
 
 // global udp connect
 var conndp *net.UDPConn
 
-// client and nonce mapping
+// how long a fortune nonce may be used, and how many may be outstanding
+var nonceTTL time.Duration
+var maxPending int
+
+// client and nonce mapping; order lists client addresses oldest nonce first,
+// which with a single TTL is also expiry order
 var fserverMap = struct {
 	sync.RWMutex
-	m map[string]int64
-}{m: make(map[string]int64)}
+	m     map[string]*fortuneNonce
+	order *list.List
+}{m: make(map[string]*fortuneNonce), order: list.New()}
+
+// Fortune nonce issued to a client through the aserver.
+type fortuneNonce struct {
+	nonce  int64
+	issued time.Time
+	elem   *list.Element // position in fserverMap.order
+	key    []byte        // session key the request must be sealed with, nil for plaintext
+}
 
 // Types
 
+// Envelope version spoken by this server
+const envelopeVersion = 1
+
+// Envelope around every message from clients that speak it. Clients that
+// predate it send bare messages and get bare replies.
+type Envelope struct {
+	Type      string          // one of the msg* types below
+	Version   int             // envelope version
+	RequestID uint64          // chosen by the client, echoed in the reply
+	Payload   json.RawMessage // message of the given type
+}
+
+// Envelope message types
+const (
+	msgError      = "error"       // ErrMessage
+	msgFortuneReq = "fortune-req" // FortuneReqMessage
+	msgFortune    = "fortune"     // FortuneMessage
+	msgSealed     = "sealed"      // SealedMessage
+)
+
 // An error message from the server.
 type ErrMessage struct {
 	Error string
 }
 
+// Errors sent in ErrMessage
+const (
+	errUnknownAddress      = "unknown remote client address"
+	errMalformed           = "could not interpret message"
+	errExpiredNonce        = "expired fortune nonce"
+	errUnknownCategory     = "unknown fortune category"
+	errUnexpectedNonce     = "incorrect fortune nonce"
+	errUnknownType         = "unknown message type"
+	errUnsupportedEnvelope = "unsupported envelope version"
+	errEncryptionRequired  = "encryption required"
+	errBadTicket           = "invalid fortune ticket"
+	errExpiredTicket       = "expired fortune ticket"
+)
+
 type FortuneServerRPC struct{}
 
 // Message with details for contacting the fortune-server.
@@ -50,9 +129,40 @@ type FortuneInfoMessage struct {
 	FortuneNonce  int64  // e.g., 2016
 }
 
+// Arguments of GetSessionFortuneInfo.
+type SessionFortuneArgs struct {
+	ClientAddr string
+	Key        []byte // session key the client seals its FortuneReqMessage with
+}
+
+// Payload of a "sealed" envelope: another envelope with the same request id,
+// encrypted and authenticated with AES-256-GCM under the session key.
+type SealedMessage struct {
+	Nonce      []byte // random, one per message
+	Ciphertext []byte
+}
+
+// Health report returned to the aserver.
+type FortuneServerHealth struct {
+	Pending int    // unused fortune nonces, a measure of load
+	Addr    string // UDP ip:port clients reach the fserver at
+}
+
 // Message requesting a fortune from the fortune-server.
 type FortuneReqMessage struct {
 	FortuneNonce int64
+	Category     string // optional fortune category
+	Ticket       string // signed Ticket from the aserver, in place of the nonce
+}
+
+// A fortune ticket, issued by the aserver instead of a fortune nonce: the
+// client at ClientAddr may ask the fserver at FortuneServer for fortunes
+// until Expiry. It travels as base64(JSON) "." base64(signature over the
+// first part).
+type Ticket struct {
+	ClientAddr    string
+	FortuneServer string // UDP ip:port of the fserver
+	Expiry        int64  // Unix time
 }
 
 // Response from the fortune-server containing the fortune.
@@ -63,6 +173,8 @@ type FortuneMessage struct {
 // Errors
 /////////////////////////////
 
+// Halt on a startup error. Errors while serving a client are logged
+// instead, a bad client must not take the server down for everyone.
 func handleError(err error) {
 	if err != nil {
 		fmt.Println("Error: ", err)
@@ -70,60 +182,180 @@ func handleError(err error) {
 	}
 }
 
-func sendUnknownAddressError(clientAddr string) {
-	var error ErrMessage
-	error.Error = "unknown remote client address"
+// A client request: who sent it and, if it came in an Envelope, the
+// envelope to answer in kind.
+type request struct {
+	clientAddr string
+	envelope   *Envelope // nil for bare messages
+	stream     net.Conn  // TCP stream the request came on, nil for UDP
+	key        []byte    // session key sealing the request and replies, nil for plaintext
+}
 
-	// encoding ErrorMessage to JSON to aserver
-	jsonError, err := json.Marshal(error)
-	handleError(err)
+// how long replies to enveloped requests are kept for retransmissions
+var replyTTL time.Duration
 
-	// client address
-	clientUdpAddr, err := net.ResolveUDPAddr("udp", clientAddr)
-	handleError(err)
+// Replies to enveloped requests by client and request id, so that a
+// retransmitted request gets the original reply instead of being handled
+// again (and failing, since nonces are single use).
+var replyCache = struct {
+	sync.Mutex
+	m map[replyKey]*cachedReply
+}{m: make(map[replyKey]*cachedReply)}
 
-	// sending ErrorMessage
-	_, err = conndp.WriteToUDP(jsonError, clientUdpAddr)
-	handleError(err)
+type replyKey struct {
+	clientAddr string
+	requestID  uint64
 }
 
-func sendMalformMessageError(clientAddr string) {
-	var error ErrMessage
-	error.Error = "could not interpret message"
+type cachedReply struct {
+	data     []byte // nil while the request is being handled
+	received time.Time
+}
 
-	// encoding ErrorMessage to JSON to aserver
-	jsonError, err := json.Marshal(error)
-	handleError(err)
+// Reports whether req was seen before, resending its reply if there is one
+// yet. Otherwise req is recorded as being handled.
+func resendReply(req request) bool {
+	key := replyKey{req.clientAddr, req.envelope.RequestID}
+	replyCache.Lock()
+	var data []byte
+	r, ok := replyCache.m[key]
+	if ok {
+		data = r.data
+	} else {
+		replyCache.m[key] = &cachedReply{received: time.Now()}
+	}
+	replyCache.Unlock()
 
-	// client address
-	clientUdpAddr, err := net.ResolveUDPAddr("udp", clientAddr)
-	handleError(err)
+	if data != nil {
+		writeToClient(req, data)
+	}
+	return ok
+}
 
-	// sending ErrorMessage
-	_, err = conndp.WriteToUDP(jsonError, clientUdpAddr)
-	handleError(err)
+// Remove replies older than replyTTL
+func expireReplies() {
+	for range time.Tick(replyTTL / 2) {
+		replyCache.Lock()
+		for key, r := range replyCache.m {
+			if time.Since(r.received) > replyTTL {
+				delete(replyCache.m, key)
+			}
+		}
+		replyCache.Unlock()
+	}
 }
 
-func sendUnexpectedNonceValueError(clientAddr string) {
-	var error ErrMessage
-	error.Error = "incorrect fortune nonce"
+// Send a message of the given type to the client, wrapped in an Envelope if
+// the request was
+func sendMessage(req request, msgType string, msg interface{}) {
+	// encoding msg to JSON
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("client %s: encoding %s: %s", req.clientAddr, msgType, err)
+		return
+	}
 
-	// encoding ErrorMessage to JSON to aserver
-	jsonError, err := json.Marshal(error)
-	handleError(err)
+	if req.envelope != nil {
+		env := Envelope{
+			Type:      msgType,
+			Version:   envelopeVersion,
+			RequestID: req.envelope.RequestID,
+			Payload:   jsonMsg,
+		}
+		if req.key != nil {
+			env, err = sealEnvelope(req.key, env)
+		}
+		if err == nil {
+			jsonMsg, err = json.Marshal(env)
+		}
+		if err != nil {
+			log.Printf("client %s: encoding %s envelope: %s", req.clientAddr, msgType, err)
+			return
+		}
+
+		key := replyKey{req.clientAddr, req.envelope.RequestID}
+		replyCache.Lock()
+		if r, ok := replyCache.m[key]; ok {
+			r.data = jsonMsg
+		}
+		replyCache.Unlock()
+	}
+
+	writeToClient(req, jsonMsg)
+
+	// every reply is the last on a stream; closing first leaves TIME_WAIT
+	// to the server, so the client can reuse its address
+	if req.stream != nil {
+		req.stream.Close()
+	}
+}
+
+// Send an encoded message to the client
+func writeToClient(req request, data []byte) {
+	if req.stream != nil {
+		req.stream.SetWriteDeadline(time.Now().Add(streamIdleTimeout))
+		if err := writeFrame(req.stream, data); err != nil {
+			log.Printf("client %s: %s", req.clientAddr, err)
+		}
+		return
+	}
 
 	// client address
-	clientUdpAddr, err := net.ResolveUDPAddr("udp", clientAddr)
-	handleError(err)
+	clientUdpAddr, err := net.ResolveUDPAddr("udp", req.clientAddr)
+	if err != nil {
+		log.Printf("client %s: %s", req.clientAddr, err)
+		return
+	}
 
-	// sending ErrorMessage
-	_, err = conndp.WriteToUDP(jsonError, clientUdpAddr)
-	handleError(err)
+	// sending msg
+	_, err = conndp.WriteToUDP(data, clientUdpAddr)
+	if err != nil {
+		log.Printf("client %s: %s", req.clientAddr, err)
+	}
+}
+
+// Send an ErrMessage to the client
+func sendError(req request, text string) {
+	log.Printf("client %s: %s", req.clientAddr, text)
+	errorCounts.inc(text)
+
+	var error ErrMessage
+	error.Error = text
+	sendMessage(req, msgError, error)
 }
 
 // RPC method that populates the FortuneInfoMessage with required information
 func (this *FortuneServerRPC) GetFortuneInfo(clientAddr string, fInfoMsg *FortuneInfoMessage) error {
-	rand.Seed(int64(time.Now().Nanosecond()))
+	rpcCounts.inc("GetFortuneInfo")
+	inflight.Add(1)
+	defer inflight.Add(-1)
+	if shuttingDown.Load() {
+		return errShuttingDown
+	}
+	issueNonce(clientAddr, nil, fInfoMsg)
+	return nil
+}
+
+// RPC method like GetFortuneInfo for a client that seals its request with
+// the given session key
+func (this *FortuneServerRPC) GetSessionFortuneInfo(args SessionFortuneArgs, fInfoMsg *FortuneInfoMessage) error {
+	rpcCounts.inc("GetSessionFortuneInfo")
+	inflight.Add(1)
+	defer inflight.Add(-1)
+	if shuttingDown.Load() {
+		return errShuttingDown
+	}
+	if len(args.Key) != 32 {
+		return errors.New("session key must be 32 bytes")
+	}
+	issueNonce(args.ClientAddr, args.Key, fInfoMsg)
+	return nil
+}
+
+// Issue a new fortune nonce to the client, replacing any it had
+func issueNonce(clientAddr string, key []byte, fInfoMsg *FortuneInfoMessage) {
+	// the global source is randomly seeded; reseeding it per call handed
+	// concurrent clients the same nonce
 	nonce := rand.Int()
 
 	var nonce64 int64
@@ -135,69 +367,657 @@ func (this *FortuneServerRPC) GetFortuneInfo(clientAddr string, fInfoMsg *Fortun
 
 	// Adding client and nonce value to global map, whilst avoiding any race conditions
 	fserverMap.Lock()
-	fserverMap.m[clientAddr] = nonce64
+	removeNonce(clientAddr)
+
+	// bound the map by dropping the oldest nonce
+	if len(fserverMap.m) >= maxPending {
+		removeNonce(fserverMap.order.Front().Value.(string))
+	}
+	fserverMap.m[clientAddr] = &fortuneNonce{
+		nonce:  nonce64,
+		issued: time.Now(),
+		elem:   fserverMap.order.PushBack(clientAddr),
+		key:    key,
+	}
 	fserverMap.Unlock()
+}
+
+// RPC method the aserver uses to health-check the fserver and weigh its load
+func (this *FortuneServerRPC) Health(unused int, health *FortuneServerHealth) error {
+	rpcCounts.inc("Health")
+	if shuttingDown.Load() {
+		return errShuttingDown
+	}
+	fserverMap.RLock()
+	health.Pending = len(fserverMap.m)
+	fserverMap.RUnlock()
+	health.Addr = fserverIpPort
+	return nil
+}
+
+// Remove a client's nonce, fserverMap must be locked
+func removeNonce(clientAddr string) {
+	if fn, ok := fserverMap.m[clientAddr]; ok {
+		fserverMap.order.Remove(fn.elem)
+		delete(fserverMap.m, clientAddr)
+	}
+}
+
+// Remove nonces that were never used
+func expireNonces() {
+	for range time.Tick(nonceTTL / 2) {
+		fserverMap.Lock()
+		for e := fserverMap.order.Front(); e != nil; e = fserverMap.order.Front() {
+			clientAddr := e.Value.(string)
+			if time.Since(fserverMap.m[clientAddr].issued) <= nonceTTL {
+				break
+			}
+			removeNonce(clientAddr)
+		}
+		fserverMap.Unlock()
+	}
+}
+
+// Fortunes
+/////////////////////////////
+
+// Parse a fortune file in the classic format: fortunes separated by lines
+// holding a single %
+func parseFortuneFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []string{}
+	lines := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "%" {
+			entries = appendFortune(entries, lines)
+			lines = lines[:0]
+		} else {
+			lines = append(lines, strings.TrimRight(line, "\r"))
+		}
+	}
+	return appendFortune(entries, lines), nil
+}
+
+func appendFortune(entries []string, lines []string) []string {
+	fortune := strings.TrimSpace(strings.Join(lines, "\n"))
+	if fortune == "" {
+		return entries
+	}
+	return append(entries, fortune)
+}
+
+// Files holding fortunes: the path itself, or the category files in it
+func fortuneFiles() ([]string, error) {
+	info, err := os.Stat(fortunes.path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{fortunes.path}, nil
+	}
+
+	entries, err := os.ReadDir(fortunes.path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, entry := range entries {
+		// skip hidden files and the strfile indexes of classic fortune packs
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || strings.HasSuffix(name, ".dat") {
+			continue
+		}
+		files = append(files, filepath.Join(fortunes.path, name))
+	}
+	return files, nil
+}
+
+// Latest modification time of the fortune path; a directory's own time
+// changes when category files are added or removed
+func fortunesModTime() (time.Time, error) {
+	info, err := os.Stat(fortunes.path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	latest := info.ModTime()
+
+	files, err := fortuneFiles()
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Load the fortune path; each file is a category named after the file
+func loadFortunes() error {
+	modTime, err := fortunesModTime()
+	if err != nil {
+		return err
+	}
+	files, err := fortuneFiles()
+	if err != nil {
+		return err
+	}
 
+	byCategory := make(map[string][]string)
+	for _, file := range files {
+		entries, err := parseFortuneFile(file)
+		if err != nil {
+			return err
+		}
+		category := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		byCategory[category] = append(byCategory[category], entries...)
+		byCategory[""] = append(byCategory[""], entries...)
+	}
+	if len(byCategory[""]) == 0 {
+		return fmt.Errorf("no fortunes in %s", fortunes.path)
+	}
+
+	fortunes.Lock()
+	fortunes.byCategory = byCategory
+	fortunes.next = make(map[string]int)
+	fortunes.modTime = modTime
+	fortunes.Unlock()
 	return nil
 }
 
-func sendFortune(clientAddr string) {
+// Reload the fortunes whenever the fortune path changes
+func watchFortunes(interval time.Duration) {
+	for range time.Tick(interval) {
+		modTime, err := fortunesModTime()
+		if err != nil {
+			log.Println("fortunes:", err)
+			continue
+		}
+
+		fortunes.Lock()
+		changed := !modTime.Equal(fortunes.modTime)
+		fortunes.Unlock()
+
+		if changed {
+			if err := loadFortunes(); err != nil {
+				log.Println("fortunes not reloaded:", err)
+			} else {
+				log.Println("fortunes reloaded from", fortunes.path)
+			}
+		}
+	}
+}
+
+// Pick a fortune from a category according to the selection policy
+func pickFortune(category string) (string, bool) {
+	fortunes.Lock()
+	defer fortunes.Unlock()
+
+	entries := fortunes.byCategory[category]
+	if len(entries) == 0 {
+		return "", false
+	}
+
+	if fortunes.policy == "round-robin" {
+		i := fortunes.next[category] % len(entries)
+		fortunes.next[category] = i + 1
+		return entries[i], true
+	}
+	return entries[rand.Intn(len(entries))], true
+}
+
+func sendFortune(fortuneString string, req request) {
 	var fortune FortuneMessage
-	fortune.Fortune = fortuneG
+	fortune.Fortune = fortuneString
+	sendMessage(req, msgFortune, fortune)
+}
 
-	// encoding ErrorMessage to JSON to aserver
-	jsonFortune, err := json.Marshal(fortune)
-	handleError(err)
+// Fortune tickets
+/////////////////////////////
 
-	// client address
-	clientUdpAddr, err := net.ResolveUDPAddr("udp", clientAddr)
-	handleError(err)
+// "hmac" or "ed25519" when tickets are accepted, empty otherwise
+var ticketAlg string
+var ticketHMACKey []byte
+var ticketPublicKey ed25519.PublicKey
 
-	// sending ErrorMessage
-	_, err = conndp.WriteToUDP(jsonFortune, clientUdpAddr)
-	handleError(err)
+// Load the ticket verification key: the hex-encoded key shared with the
+// aserver for hmac, a PKIX PEM public key for ed25519
+func loadTicketKey(alg string, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch alg {
+	case "hmac":
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		if len(key) < 32 {
+			return fmt.Errorf("%s: hmac key shorter than 32 bytes", path)
+		}
+		ticketHMACKey = key
+	case "ed25519":
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return fmt.Errorf("%s: no PEM data", path)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		publicKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("%s: not an ed25519 public key", path)
+		}
+		ticketPublicKey = publicKey
+	default:
+		return fmt.Errorf("unknown ticket algorithm %q", alg)
+	}
+	ticketAlg = alg
+	return nil
+}
+
+// Returns the ticket in an encoded ticket whose signature checks out
+func verifyTicket(encoded string) (Ticket, error) {
+	if ticketAlg == "" {
+		return Ticket{}, errors.New("tickets not accepted")
+	}
+	signed, sigText, ok := strings.Cut(encoded, ".")
+	if !ok {
+		return Ticket{}, errors.New("no ticket signature")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(sigText)
+	if err != nil {
+		return Ticket{}, err
+	}
+
+	if ticketAlg == "hmac" {
+		h := hmac.New(sha256.New, ticketHMACKey)
+		h.Write([]byte(signed))
+		ok = hmac.Equal(sig, h.Sum(nil))
+	} else {
+		ok = ed25519.Verify(ticketPublicKey, []byte(signed), sig)
+	}
+	if !ok {
+		return Ticket{}, errors.New("bad ticket signature")
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(signed)
+	if err != nil {
+		return Ticket{}, err
+	}
+	var t Ticket
+	err = json.Unmarshal(body, &t)
+	return t, err
+}
+
+// Serve a request carrying a ticket. Tickets are checked without any state,
+// so a client may redeem its ticket until it expires.
+func processTicket(frm FortuneReqMessage, req request) {
+	t, err := verifyTicket(frm.Ticket)
+	if err != nil || t.ClientAddr != req.clientAddr || t.FortuneServer != fserverIpPort {
+		sendError(req, errBadTicket)
+		return
+	}
+	if time.Now().Unix() > t.Expiry {
+		sendError(req, errExpiredTicket)
+		return
+	}
+
+	if fortune, ok := pickFortune(frm.Category); ok {
+		fortuneCounts.inc(frm.Category)
+		sendFortune(fortune, req)
+	} else {
+		sendError(req, errUnknownCategory)
+	}
 }
 
-func processReqMessage(frm FortuneReqMessage, clientAddr string) {
+func processReqMessage(frm FortuneReqMessage, req request) {
+	if frm.Ticket != "" {
+		processTicket(frm, req)
+		return
+	}
 
-	nonce := frm.FortuneNonce
+	// replies go out once the map is unlocked
+	fortune, errText := redeemNonce(frm, req)
+	if errText != "" {
+		sendError(req, errText)
+		return
+	}
+	fortuneCounts.inc(frm.Category)
+	sendFortune(fortune, req)
+}
+
+// Check the client's nonce and pick its fortune, using the nonce up. Returns
+// the fortune, or the error to send instead.
+func redeemNonce(frm FortuneReqMessage, req request) (string, string) {
+	clientAddr := req.clientAddr
 	fserverMap.Lock()
-	if nonce64, ok := fserverMap.m[clientAddr]; ok {
+	defer fserverMap.Unlock()
 
-		// check if hash value matches, if not, error
-		if nonce == nonce64 {
-			sendFortune(clientAddr)
+	fn, ok := fserverMap.m[clientAddr]
+	if !ok {
+		return "", errUnknownAddress
+	}
 
-		} else {
+	// check if nonce is still valid and matches, if not, error
+	if fn.key != nil && req.key == nil {
+		// the nonce was given out sealed, so must be the request
+		return "", errEncryptionRequired
+	}
+	if time.Since(fn.issued) > nonceTTL {
+		removeNonce(clientAddr)
+		return "", errExpiredNonce
+	}
+	if frm.FortuneNonce != fn.nonce {
+		return "", errUnexpectedNonce
+	}
+
+	// a nonce buys a single fortune, keep it if there is none to give
+	fortune, ok := pickFortune(frm.Category)
+	if !ok {
+		return "", errUnknownCategory
+	}
+	removeNonce(clientAddr)
+	return fortune, ""
+}
+
+// Returns an AES-256-GCM cipher keyed with a session key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns env encrypted under key in a sealed envelope with its request id
+func sealEnvelope(key []byte, env Envelope) (Envelope, error) {
+	plain, err := json.Marshal(env)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return Envelope{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		return Envelope{}, err
+	}
+
+	payload, err := json.Marshal(SealedMessage{
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plain, nil),
+	})
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{
+		Type:      msgSealed,
+		Version:   envelopeVersion,
+		RequestID: env.RequestID,
+		Payload:   payload,
+	}, nil
+}
+
+// Returns the envelope sealed in env, which must have been sealed under key
+// with the same request id
+func openEnvelope(key []byte, env Envelope) (Envelope, error) {
+	var sealed SealedMessage
+	if err := json.Unmarshal(env.Payload, &sealed); err != nil {
+		return Envelope{}, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return Envelope{}, err
+	}
+	if len(sealed.Nonce) != aead.NonceSize() {
+		return Envelope{}, errors.New("bad sealed nonce size")
+	}
+	plain, err := aead.Open(nil, sealed.Nonce, sealed.Ciphertext, nil)
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	var inner Envelope
+	if err := json.Unmarshal(plain, &inner); err != nil {
+		return Envelope{}, err
+	}
+	if inner.RequestID != env.RequestID {
+		return Envelope{}, errors.New("sealed request id does not match")
+	}
+	return inner, nil
+}
 
-			sendUnexpectedNonceValueError(clientAddr)
+// TCP stream transport
+//////////////////////////////
+
+// largest frame accepted on a client stream
+const maxFrame = 1 << 20
+
+// how long a client stream may sit idle before it is closed
+const streamIdleTimeout = 30 * time.Second
+
+// Write msg to a stream as a frame: its length as a 4 byte big-endian
+// integer, then msg
+func writeFrame(w io.Writer, msg []byte) error {
+	frame := make([]byte, 4+len(msg))
+	binary.BigEndian.PutUint32(frame, uint32(len(msg)))
+	copy(frame[4:], msg)
+	_, err := w.Write(frame)
+	return err
+}
+
+// Read a frame written by writeFrame
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[:])
+	if n > maxFrame {
+		return nil, fmt.Errorf("frame of %d bytes is over %d", n, maxFrame)
+	}
+	msg := make([]byte, n)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+// Accept clients on TCP streams until ctx is done
+func acceptStreams(ctx context.Context, ln *net.TCPListener) {
+	// the deadline fails the Accept in progress
+	go func() {
+		<-ctx.Done()
+		ln.SetDeadline(time.Now())
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Printf("accepting client stream: %s", err)
+			continue
 		}
+		go serveStream(conn)
+	}
+	ln.Close()
+}
 
+// Handle the frames on a client stream one at a time, until the last reply
+// closes it
+func serveStream(conn net.Conn) {
+	defer conn.Close()
+	clientAddr := conn.RemoteAddr().String()
+	for {
+		conn.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+		msg, err := readFrame(conn)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("client %s: %s", clientAddr, err)
+			}
+			return
+		}
+		inflight.Add(1)
+		handleClientConnection(msg, len(msg), clientAddr, conn)
+		inflight.Add(-1)
+	}
+}
+
+// Dispatch an enveloped message on its type
+func handleEnvelope(env Envelope, req request) {
+	clientAddr := req.clientAddr
+	req.envelope = &env
+	if env.Type == msgFortuneReq || env.Type == msgSealed {
+		requestCounts.inc(env.Type)
 	} else {
-		sendUnknownAddressError(clientAddr)
+		requestCounts.inc("other")
+	}
+	if env.Version != envelopeVersion {
+		sendError(req, errUnsupportedEnvelope)
+		return
 	}
-	fserverMap.Unlock()
 
+	// a retransmission gets the original reply, or none if that is still
+	// being worked out
+	if resendReply(req) {
+		return
+	}
+
+	switch env.Type {
+	case msgFortuneReq:
+		var fortuneReqMessage FortuneReqMessage
+		if json.Unmarshal(env.Payload, &fortuneReqMessage) != nil {
+			sendError(req, errMalformed)
+			return
+		}
+		processReqMessage(fortuneReqMessage, req)
+
+	case msgSealed:
+		// only a client given its nonce with a session key can seal
+		fserverMap.RLock()
+		var key []byte
+		if fn, ok := fserverMap.m[clientAddr]; ok {
+			key = fn.key
+		}
+		fserverMap.RUnlock()
+		if key == nil {
+			sendError(req, errUnknownAddress)
+			return
+		}
+
+		inner, err := openEnvelope(key, env)
+		var fortuneReqMessage FortuneReqMessage
+		if err != nil || inner.Type != msgFortuneReq ||
+			json.Unmarshal(inner.Payload, &fortuneReqMessage) != nil {
+			sendError(req, errMalformed)
+			return
+		}
+		req.key = key
+		processReqMessage(fortuneReqMessage, req)
+
+	default:
+		sendError(req, errUnknownType)
+	}
 }
 
-func handleClientConnection(buf []byte, n int, clientAddr string) {
-	// check message, if it's a hash, process hash, if not, send nonce
+func handleClientConnection(buf []byte, n int, clientAddr string, stream net.Conn) {
+	// a bug hit by one client's datagram only fails that request
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("client %s: panic handling %q: %v", clientAddr, buf[:n], r)
+		}
+	}()
+
+	// enveloped messages say what they are
+	var env Envelope
+	if json.Unmarshal(buf[:n], &env) == nil && env.Type != "" {
+		handleEnvelope(env, request{clientAddr: clientAddr, stream: stream})
+		return
+	}
+
+	// bare message: must be a FortuneReqMessage
+	requestCounts.inc(msgFortuneReq)
+	req := request{clientAddr: clientAddr, stream: stream}
 	var fortuneReqMessage FortuneReqMessage
 	err := json.Unmarshal(buf[:n], &fortuneReqMessage)
 	if err != nil {
 
 		// Sending malform message error
-		sendMalformMessageError(clientAddr)
+		sendError(req, errMalformed)
 
 	} else {
 
-		processReqMessage(fortuneReqMessage, clientAddr)
+		processReqMessage(fortuneReqMessage, req)
+
+	}
+}
+
+// TLS for the RPC link, nil for plain TCP
+var rpcTLS *tls.Config
+
+// longest wait for an aserver to complete the TLS handshake
+const handshakeTimeout = 10 * time.Second
+
+// Returns the TLS config the RPC link is served with: the fserver's
+// certificate, and the CA aserver client certificates must be signed by
+func loadRPCTLS(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("%s: no CA certificate", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
 
+// Serve RPCs on an aserver connection; over TLS only once the aserver has
+// shown a certificate signed by the CA
+func serveRpcConnection(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("rejected aserver connection from %s: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
 	}
+	rpc.ServeConn(conn)
 }
 
-// Handles connection from aserver through an rpc interface
-func handleRpcConnection() {
+// Handles connection from aserver through an rpc interface, until ctx is
+// done. Connections already open keep being served, so calls in progress
+// can finish.
+func handleRpcConnection(ctx context.Context) {
 
 	fortuneServerRPC := new(FortuneServerRPC)
 	rpc.Register(fortuneServerRPC)
@@ -206,67 +1026,362 @@ func handleRpcConnection() {
 	handleError(err)
 
 	// Listen for Tcp connections
-	ln, err := net.ListenTCP("tcp", tcpAddress)
+	tcpLn, err := net.ListenTCP("tcp", tcpAddress)
 	handleError(err)
+	var ln net.Listener = tcpLn
+	if rpcTLS != nil {
+		ln = tls.NewListener(tcpLn, rpcTLS)
+	}
+
+	// the deadline fails the Accept in progress
+	go func() {
+		<-ctx.Done()
+		tcpLn.SetDeadline(time.Now())
+	}()
 
 	for {
 
-		conn, err := ln.AcceptTCP()
-		handleError(err)
-		go rpc.ServeConn(conn)
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Printf("accepting aserver connection: %s", err)
+			continue
+		}
+		go serveRpcConnection(conn)
 	}
 
 	ln.Close()
 }
 
+// Metrics
+//////////////////////////////
+
+// Counts by the value of a single label
+type counterVec struct {
+	sync.Mutex
+	m map[string]int64
+}
+
+func (c *counterVec) inc(value string) {
+	c.Lock()
+	if c.m == nil {
+		c.m = make(map[string]int64)
+	}
+	c.m[value]++
+	c.Unlock()
+}
+
+func (c *counterVec) total() int64 {
+	c.Lock()
+	defer c.Unlock()
+	var n int64
+	for _, count := range c.m {
+		n += count
+	}
+	return n
+}
+
+// enveloped and bare requests by type, "other" for unknown types
+var requestCounts counterVec
+
+// ErrMessages sent by error text
+var errorCounts counterVec
+
+// fortunes sent by requested category, "" for none
+var fortuneCounts counterVec
+
+// RPC calls from the aserver by method
+var rpcCounts counterVec
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Write the HELP and TYPE lines of a metric
+func writeMetricHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Write a counter with one sample per label value, in label order
+func writeCounterVec(w io.Writer, name string, label string, help string, c *counterVec) {
+	writeMetricHeader(w, name, "counter", help)
+	c.Lock()
+	values := make([]string, 0, len(c.m))
+	for value := range c.m {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, labelEscaper.Replace(value), c.m[value])
+	}
+	c.Unlock()
+}
+
+// Write a metric with a single unlabelled sample
+func writeMetric(w io.Writer, name string, kind string, help string, value int64) {
+	writeMetricHeader(w, name, kind, help)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+// Serve the metrics in the Prometheus text exposition format
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeCounterVec(w, "fserver_requests_total", "type", "Client requests by message type.", &requestCounts)
+	writeCounterVec(w, "fserver_errors_sent_total", "error", "ErrMessages sent to clients, by error.", &errorCounts)
+	writeCounterVec(w, "fserver_fortunes_served_total", "category", "Fortunes sent, by requested category.", &fortuneCounts)
+	writeCounterVec(w, "fserver_rpc_calls_total", "method", "RPC calls from the aserver, by method.", &rpcCounts)
+
+	// map sizes
+	fserverMap.RLock()
+	pending := len(fserverMap.m)
+	fserverMap.RUnlock()
+	replyCache.Lock()
+	replies := len(replyCache.m)
+	replyCache.Unlock()
+	fortunes.Lock()
+	loaded := len(fortunes.byCategory[""])
+	fortunes.Unlock()
+	writeMetric(w, "fserver_pending_nonces", "gauge", "Fortune nonces issued and not yet used.", int64(pending))
+	writeMetric(w, "fserver_reply_cache_entries", "gauge", "Replies kept for retransmitted requests.", int64(replies))
+	writeMetric(w, "fserver_fortunes", "gauge", "Fortunes loaded.", int64(loaded))
+}
+
+// Serve the metrics at /metrics on addr
+func serveMetricsOn(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	go func() {
+		log.Printf("metrics: %s", http.Serve(ln, mux))
+	}()
+	return nil
+}
+
+// Shutdown
+//////////////////////////////
+
+// set on SIGTERM or SIGINT: the aserver is refused new fortune nonces, and
+// clients holding one get until drainTimeout to use it
+var shuttingDown atomic.Bool
+
+var errShuttingDown = errors.New("fserver shutting down")
+
+// requests and RPC calls not yet handled
+var inflight atomic.Int64
+
+// how long clients holding a fortune nonce get on shutdown
+var drainTimeout time.Duration
+
+// how often draining checks for work left
+const drainPoll = 50 * time.Millisecond
+
+// Stop issuing fortune nonces and wait until every nonce issued has been
+// used or has expired and no request or call is being handled, or
+// drainTimeout passes. Reports whether everything finished.
+func drain() bool {
+	shuttingDown.Store(true)
+	log.Printf("shutting down, draining for up to %s", drainTimeout)
+
+	deadline := time.Now().Add(drainTimeout)
+	for time.Now().Before(deadline) {
+		fserverMap.RLock()
+		pending := len(fserverMap.m)
+		fserverMap.RUnlock()
+		if pending == 0 && inflight.Load() == 0 {
+			return true
+		}
+		time.Sleep(drainPoll)
+	}
+	return false
+}
+
+// Log what the fserver did and what it left unfinished
+func logShutdown(drained bool) {
+	fserverMap.RLock()
+	pending := len(fserverMap.m)
+	fserverMap.RUnlock()
+
+	status := "drained"
+	if !drained {
+		status = "drain deadline passed"
+	}
+	log.Printf("fserver stopped, %s: %d requests, %d fortunes served; "+
+		"%d nonces unused, %d requests unfinished",
+		status, requestCounts.total(), fortuneCounts.total(), pending, inflight.Load())
+}
+
 /*Usage:
 
-go run fortune-server.go [fserver RPC ip:port] [fserver UDP ip:port] [fortune-string]
+go run fortune-server.go [flags] [fserver RPC ip:port] [fserver UDP ip:port] [fortune-string]
 [fserver RPC ip:port] : the TCP address on which the fserver listens to RPC connections from the aserver
 [fserver UDP ip:port] : the UDP address on which the fserver receives client connections
-[fortune-string] : a fortune string that may include spaces, but not other whitespace characters
+[fortune-string] : a fortune string that may include spaces, but not other whitespace characters;
+optional with -fortunes
+Run with -h for the list of flags.
 
 */
 
 func main() {
 
 	// Process args.
+	flag.DurationVar(&nonceTTL, "nonce-ttl", 30*time.Second,
+		"how long a client has to use its fortune nonce")
+	flag.DurationVar(&replyTTL, "reply-ttl", 30*time.Second,
+		"how long replies are kept to answer retransmitted requests")
+	flag.IntVar(&maxPending, "max-pending", 10000,
+		"most unused fortune nonces kept; the oldest is dropped beyond this")
+	flag.StringVar(&fortunes.path, "fortunes", "",
+		"%-delimited fortune file, or a directory with one file per category")
+	flag.StringVar(&fortunes.policy, "policy", "random",
+		"fortune selection policy: random or round-robin")
+	fortunesReload := flag.Duration("fortunes-reload", 5*time.Second,
+		"how often to check the fortunes for changes")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr,
+			"Usage: %s [flags] [fserver RPC ip:port] [fserver UDP ip:port] [fortune-string]\n",
+			os.Args[0])
+		flag.PrintDefaults()
+	}
+	tlsCA := flag.String("tls-ca", "", "CA certificate aserver client certificates must be signed by")
+	tlsCert := flag.String("tls-cert", "", "certificate the RPC link is served with")
+	tlsKey := flag.String("tls-key", "", "key of the -tls-cert certificate")
+	tcpClients := flag.Bool("tcp", false,
+		"also serve clients over TCP at the same address, messages framed by a 4 byte length")
+	ticketKey := flag.String("ticket-key", "",
+		"key file verifying fortune tickets from the aserver")
+	ticketAlgName := flag.String("ticket-alg", "hmac", "ticket signature: hmac or ed25519")
+	flag.DurationVar(&drainTimeout, "drain", 10*time.Second,
+		"how long clients holding a fortune nonce get to use it on SIGTERM")
+	metricsAddr := flag.String("metrics", "",
+		"ip:port serving Prometheus metrics at /metrics, e.g. 127.0.0.1:9101 (none by default)")
+	flag.Parse()
+
+	if flag.NArg() < 3 && (flag.NArg() != 2 || fortunes.path == "") {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if nonceTTL <= 0 || replyTTL <= 0 || maxPending <= 0 || *fortunesReload <= 0 || drainTimeout < 0 {
+		fmt.Fprintln(os.Stderr, "nonce-ttl, reply-ttl, max-pending and fortunes-reload must be positive, drain not negative")
+		os.Exit(1)
+	}
+	if fortunes.policy != "random" && fortunes.policy != "round-robin" {
+		fmt.Fprintf(os.Stderr, "unknown policy %q\n", fortunes.policy)
+		os.Exit(1)
+	}
+
+	// TLS with aserver client certificates on the RPC link, all or nothing
+	if *tlsCA != "" || *tlsCert != "" || *tlsKey != "" {
+		if *tlsCA == "" || *tlsCert == "" || *tlsKey == "" {
+			fmt.Fprintln(os.Stderr, "tls-ca, tls-cert and tls-key go together")
+			os.Exit(1)
+		}
+		var err error
+		rpcTLS, err = loadRPCTLS(*tlsCA, *tlsCert, *tlsKey)
+		handleError(err)
+	}
+
+	// tickets, alongside nonces from GetFortuneInfo
+	if *ticketKey != "" {
+		err := loadTicketKey(*ticketAlgName, *ticketKey)
+		handleError(err)
+	}
 
 	// the TCP address on which the fserver listens to RPC connections from the aserver
-	fserverTcp := os.Args[1]
+	fserverTcp := flag.Arg(0)
 	fserverTcpG = fserverTcp
 
 	// the UDP address on which the fserver receives client connections
-	fserver := os.Args[2]
+	fserver := flag.Arg(1)
 	fserverUdpAddr, err := net.ResolveUDPAddr("udp", fserver)
 	handleError(err)
 
-	msg := make([]byte, 1024)
-
 	// Global fserver ip:port info
 	fserverIpPort = fserver
 
-	// Read the rest of the args as a fortune message
-	fortune := strings.Join(os.Args[3:], " ")
-	fortuneG = fortune
-
 	// Debug to see input from command line args
-	fmt.Printf("fserver Listening on %s\nFortune: %s\n", fserverIpPort, fortune)
+	fmt.Printf("fserver Listening on %s\n", fserverIpPort)
+
+	if fortunes.path != "" {
+		err = loadFortunes()
+		handleError(err)
+		go watchFortunes(*fortunesReload)
+
+		categories := []string{}
+		for category := range fortunes.byCategory {
+			if category != "" {
+				categories = append(categories, category)
+			}
+		}
+		sort.Strings(categories)
+		fmt.Printf("Fortunes: %d from %s, categories: %s\n",
+			len(fortunes.byCategory[""]), fortunes.path, strings.Join(categories, " "))
+	} else {
+		// Read the rest of the args as a fortune message
+		fortune := strings.Join(flag.Args()[2:], " ")
+		fortunes.byCategory[""] = []string{fortune}
+		fmt.Printf("Fortune: %s\n", fortune)
+	}
 
 	// concurrent running of rcp connection
 
 	conn, err := net.ListenUDP("udp", fserverUdpAddr)
 	handleError(err)
 
-	go handleRpcConnection()
+	if *metricsAddr != "" {
+		err = serveMetricsOn(*metricsAddr)
+		handleError(err)
+	}
+
+	// on SIGTERM or SIGINT, stop taking new clients and drain
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	go handleRpcConnection(ctx)
+	go expireNonces()
+	go expireReplies()
 	defer conn.Close()
 
 	// refactor to global variable
 	conndp = conn
-	// udp client concurrency
+
+	// clients on TCP streams, at the same address
+	if *tcpClients {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", fserver)
+		handleError(err)
+		ln, err := net.ListenTCP("tcp", tcpAddr)
+		handleError(err)
+		go acceptStreams(ctx, ln)
+	}
+
+	// clients keep being read while draining, so nonces already issued can
+	// be used; the deadline then fails the read in progress
+	drained := make(chan bool, 1)
+	go func() {
+		<-ctx.Done()
+		drained <- drain()
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	// udp client concurrency, each datagram in its own buffer
 	for {
+		msg := make([]byte, 1024)
 		n, clientAddr, err := conn.ReadFromUDP(msg)
-		handleError(err)
-		go handleClientConnection(msg[:], n, clientAddr.String())
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			log.Printf("reading client datagram: %s", err)
+			continue
+		}
+		inflight.Add(1)
+		go func() {
+			handleClientConnection(msg[:n], n, clientAddr.String(), nil)
+			inflight.Add(-1)
+		}()
 	}
+	logShutdown(<-drained)
 }
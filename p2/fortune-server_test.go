@@ -0,0 +1,284 @@
+// Tests of the fserver's client protocol. handleClientConnection is called
+// directly with the address of a loopback UDP socket, which then receives the
+// replies.
+//
+// go test -race fortune-server.go fortune-server_test.go
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// nonce the tests hand their client
+const testNonce = 2016
+
+// session key of sealed test requests
+var testKey = bytes.Repeat([]byte{7}, 32)
+
+// Reset the fserver for a test: one fortune in each of two categories, and
+// no nonces
+func setupFserver(t testing.TB) {
+	fserverIpPort = "127.0.0.1:1"
+	nonceTTL, replyTTL, maxPending = 30*time.Second, 30*time.Second, 10000
+	ticketAlg = ""
+	shuttingDown.Store(false)
+
+	fortunes.policy = "round-robin"
+	fortunes.byCategory = map[string][]string{"": {"fortune"}, "wisdom": {"fortune"}}
+	fortunes.next = make(map[string]int)
+	resetFserverState()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conndp = conn
+}
+
+// Forget every nonce and reply
+func resetFserverState() {
+	fserverMap.m = make(map[string]*fortuneNonce)
+	fserverMap.order = list.New()
+	replyCache.m = make(map[replyKey]*cachedReply)
+}
+
+// Give the client testNonce, sealed with key if it is not nil
+func giveNonce(clientAddr string, key []byte) {
+	fserverMap.Lock()
+	removeNonce(clientAddr)
+	fserverMap.m[clientAddr] = &fortuneNonce{
+		nonce:  testNonce,
+		issued: time.Now(),
+		elem:   fserverMap.order.PushBack(clientAddr),
+		key:    key,
+	}
+	fserverMap.Unlock()
+}
+
+// A loopback UDP socket for a client
+func newClientConn(t testing.TB) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// Encode msg in an envelope, sealed with key if it is not nil
+func encodeEnvelope(t testing.TB, id uint64, msgType string, msg interface{}, key []byte) []byte {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := Envelope{Type: msgType, Version: envelopeVersion, RequestID: id, Payload: payload}
+	if key != nil {
+		if env, err = sealEnvelope(key, env); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Counts the panics handleClientConnection recovers from, which it logs
+type panicCounter struct {
+	n atomic.Int64
+}
+
+func (p *panicCounter) Write(b []byte) (int, error) {
+	if bytes.Contains(b, []byte("panic handling")) {
+		p.n.Add(1)
+	}
+	return len(b), nil
+}
+
+// Send the log to a panicCounter for the rest of the test
+func countPanics(t testing.TB) *panicCounter {
+	p := &panicCounter{}
+	log.SetOutput(p)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return p
+}
+
+// Fail the test if a handler left shared state locked. A leaked lock is
+// replaced, so that the inputs after it still run.
+func checkUnlocked(t testing.TB) {
+	t.Helper()
+	if fserverMap.TryLock() {
+		fserverMap.Unlock()
+	} else {
+		fserverMap.RWMutex = sync.RWMutex{}
+		t.Error("fserverMap left locked")
+	}
+	if replyCache.TryLock() {
+		replyCache.Unlock()
+	} else {
+		replyCache.Mutex = sync.Mutex{}
+		t.Error("replyCache left locked")
+	}
+	if fortunes.TryLock() {
+		fortunes.Unlock()
+	} else {
+		fortunes.Mutex = sync.Mutex{}
+		t.Error("fortunes left locked")
+	}
+}
+
+// Frames of any size up to maxFrame come back as written, one at a time
+func TestFrameRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, 1023, 1024, 1025, 64 << 10, maxFrame}
+	var stream bytes.Buffer
+	for i, n := range sizes {
+		if err := writeFrame(&stream, bytes.Repeat([]byte{byte(i)}, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, n := range sizes {
+		msg, err := readFrame(&stream)
+		if err != nil || !bytes.Equal(msg, bytes.Repeat([]byte{byte(i)}, n)) {
+			t.Fatalf("frame %d: read %d bytes, %v; want %d", i, len(msg), err, n)
+		}
+	}
+	if _, err := readFrame(&stream); err != io.EOF {
+		t.Fatalf("got %v at the end of the stream, want EOF", err)
+	}
+}
+
+// Oversize and cut short frames are errors
+func TestBadFrames(t *testing.T) {
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], maxFrame+1)
+	if _, err := readFrame(bytes.NewReader(header[:])); err == nil {
+		t.Error("frame over maxFrame read")
+	}
+	if _, err := readFrame(bytes.NewReader(header[:2])); err != io.ErrUnexpectedEOF {
+		t.Errorf("cut short header: got %v, want ErrUnexpectedEOF", err)
+	}
+
+	var stream bytes.Buffer
+	writeFrame(&stream, []byte("fortune"))
+	if _, err := readFrame(bytes.NewReader(stream.Bytes()[:stream.Len()-1])); err != io.ErrUnexpectedEOF {
+		t.Errorf("cut short frame: got %v, want ErrUnexpectedEOF", err)
+	}
+}
+
+// A fortune too long for a datagram comes whole over a client stream, which
+// the fserver then closes; sealed too
+func TestStreamFortune(t *testing.T) {
+	setupFserver(t)
+	fortune := strings.Repeat("all work and no play ", 300)
+	fortunes.byCategory["long"] = []string{fortune}
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go acceptStreams(ctx, ln)
+
+	for _, key := range [][]byte{nil, testKey} {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		giveNonce(conn.LocalAddr().String(), key)
+
+		req := FortuneReqMessage{FortuneNonce: testNonce, Category: "long"}
+		if err := writeFrame(conn, encodeEnvelope(t, 1, msgFortuneReq, req, key)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		data, err := readFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var env Envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			t.Fatal(err)
+		}
+		if key != nil {
+			if env, err = openEnvelope(key, env); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var reply FortuneMessage
+		if env.Type != msgFortune || json.Unmarshal(env.Payload, &reply) != nil || reply.Fortune != fortune {
+			t.Fatalf("got %s reply of %d bytes, want the %d byte fortune", env.Type, len(env.Payload), len(fortune))
+		}
+		if _, err := readFrame(conn); err != io.EOF {
+			t.Fatalf("got %v after the reply, want EOF", err)
+		}
+	}
+}
+
+// Malformed datagrams must neither panic nor leave a lock held. The client
+// holds testNonce, sealed for inputs of odd length.
+func FuzzFserverDatagram(f *testing.F) {
+	setupFserver(f)
+	clientAddr := newClientConn(f).LocalAddr().String()
+	panics := countPanics(f)
+
+	fortuneReq := FortuneReqMessage{FortuneNonce: testNonce, Category: "wisdom"}
+	seeds := [][]byte{
+		nil,
+		[]byte("{}"),
+		[]byte("null"),
+		[]byte("[]"),
+		[]byte(`"fortune-req"`),
+		[]byte(`{"FortuneNonce":2016}`),
+		[]byte(`{"FortuneNonce":2016,"Category":"none"}`),
+		[]byte(`{"FortuneNonce":"2016"}`),
+		[]byte(`{"Ticket":"x.y"}`),
+		[]byte(`{"Ticket":"."}`),
+		[]byte(`{"Type":"fortune-req","Version":1,"Payload":null}`),
+		[]byte(`{"Type":"fortune-req","Version":1,"Payload":[1,2]}`),
+		[]byte(`{"Type":"fortune-req","Version":2,"Payload":{}}`),
+		[]byte(`{"Type":"sealed","Version":1,"Payload":{}}`),
+		[]byte(`{"Type":"sealed","Version":1,"Payload":{"Nonce":"","Ciphertext":""}}`),
+		[]byte(`{"Type":"sealed","Version":1,"Payload":{"Nonce":"AAAA","Ciphertext":"AAAA"}}`),
+		[]byte(`{"Type":"nonce-req","Version":1,"RequestID":18446744073709551615}`),
+		encodeEnvelope(f, 1, msgFortuneReq, fortuneReq, nil),
+		encodeEnvelope(f, 2, msgFortuneReq, fortuneReq, testKey),
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		resetFserverState()
+		var key []byte
+		if len(data)%2 == 1 {
+			key = testKey
+		}
+		giveNonce(clientAddr, key)
+
+		before := panics.n.Load()
+		handleClientConnection(data, len(data), clientAddr, nil)
+		if panics.n.Load() != before {
+			t.Errorf("panic handling %q", data)
+		}
+		checkUnlocked(t)
+	})
+}
@@ -0,0 +1,213 @@
+/*
+Generates a local test CA and certificates for the TLS link between the
+aserver and the fservers (auth-server.go and fortune-server.go -tls-*), and
+fortune ticket keys (-ticket-key). For development only: the keys are
+written unencrypted.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A certificate and its key, ready to sign others.
+type keyPair struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func handleError(err error) {
+	if err != nil {
+		fmt.Println("Error: ", err)
+		os.Exit(-1)
+	}
+}
+
+// Write a PEM block to path, readable only by the owner if it is a key
+func writePEM(path string, blockType string, der []byte) error {
+	mode := os.FileMode(0644)
+	if strings.Contains(blockType, "PRIVATE KEY") {
+		mode = 0600
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(file, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Create a certificate from template with a new key, signed by parent, or
+// self-signed if parent is nil, and write both to dir/name.pem and
+// dir/name-key.pem
+func issue(dir string, name string, template *x509.Certificate, parent *keyPair) (*keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePEM(filepath.Join(dir, name+".pem"), "CERTIFICATE", der); err != nil {
+		return nil, err
+	}
+	if err := writePEM(filepath.Join(dir, name+"-key.pem"), "EC PRIVATE KEY", keyDer); err != nil {
+		return nil, err
+	}
+	return &keyPair{cert: cert, key: key}, nil
+}
+
+// Write fresh fortune ticket keys to dir: ticket-hmac.key shared by the
+// aserver and fservers, and ticket-ed25519-key.pem for the aserver with
+// ticket-ed25519.pem for the fservers
+func writeTicketKeys(dir string) error {
+	hmacKey := make([]byte, 32)
+	if _, err := rand.Read(hmacKey); err != nil {
+		return err
+	}
+	err := os.WriteFile(filepath.Join(dir, "ticket-hmac.key"),
+		[]byte(hex.EncodeToString(hmacKey)+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	privateDer, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+	publicDer, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	err = writePEM(filepath.Join(dir, "ticket-ed25519-key.pem"), "PRIVATE KEY", privateDer)
+	if err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(dir, "ticket-ed25519.pem"), "PUBLIC KEY", publicDer)
+}
+
+/*Usage:
+
+go run gencerts.go [flags]
+
+Writes to the -dir directory:
+ca.pem, ca-key.pem           : the test CA, given to both servers with -tls-ca
+fserver.pem, fserver-key.pem : the fservers' certificate, valid for -hosts
+aserver.pem, aserver-key.pem : the aserver's client certificate
+ticket-hmac.key              : a shared fortune ticket key, for both servers' -ticket-key
+ticket-ed25519-key.pem       : a fortune ticket signing key, for the aserver's -ticket-key
+ticket-ed25519.pem           : its public key, for the fservers' -ticket-key
+
+Example:
+go run gencerts.go -dir certs -hosts 127.0.0.1,localhost
+go run fortune-server.go -tls-ca certs/ca.pem -tls-cert certs/fserver.pem -tls-key certs/fserver-key.pem 127.0.0.1:2001 127.0.0.1:2002 hello
+go run auth-server.go -tls-ca certs/ca.pem -tls-cert certs/aserver.pem -tls-key certs/aserver-key.pem 127.0.0.1:2000 127.0.0.1:2001 42
+*/
+
+func main() {
+	dir := flag.String("dir", "certs", "directory the certificates and keys are written to")
+	hosts := flag.String("hosts", "127.0.0.1,localhost",
+		"comma-separated IP addresses and host names the fservers are reached at")
+	validFor := flag.Duration("valid-for", 365*24*time.Hour, "how long the certificates are valid")
+	flag.Parse()
+
+	if flag.NArg() != 0 || *validFor <= 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	err := os.MkdirAll(*dir, 0755)
+	handleError(err)
+
+	notBefore := time.Now().Add(-time.Hour)
+	notAfter := notBefore.Add(*validFor)
+
+	ca, err := issue(*dir, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "fortune test CA"},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil)
+	handleError(err)
+
+	// the fservers serve RPC; the aserver checks their certificate against
+	// the address it dials
+	fserverTemplate := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "fserver"},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range strings.Split(*hosts, ",") {
+		host = strings.TrimSpace(host)
+		if ip := net.ParseIP(host); ip != nil {
+			fserverTemplate.IPAddresses = append(fserverTemplate.IPAddresses, ip)
+		} else if host != "" {
+			fserverTemplate.DNSNames = append(fserverTemplate.DNSNames, host)
+		}
+	}
+	_, err = issue(*dir, "fserver", fserverTemplate, ca)
+	handleError(err)
+
+	// the aserver is the RPC client
+	_, err = issue(*dir, "aserver", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "aserver"},
+		NotBefore:   notBefore,
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	handleError(err)
+
+	err = writeTicketKeys(*dir)
+	handleError(err)
+
+	fmt.Printf("Wrote test CA, certificates and ticket keys to %s\n", *dir)
+}
@@ -0,0 +1,401 @@
+// End-to-end tests: the aserver, fserver and p1 client are built and run as
+// separate processes on loopback.
+//
+// go test integration_test.go
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Paths of the programs under test
+type programs struct {
+	aserver, fserver, client string
+}
+
+// Build the aserver, fserver and client for a test
+func buildPrograms(t *testing.T) programs {
+	if testing.Short() {
+		t.Skip("builds and runs the servers")
+	}
+	dir := t.TempDir()
+	p := programs{
+		aserver: filepath.Join(dir, "auth-server"),
+		fserver: filepath.Join(dir, "fortune-server"),
+		client:  filepath.Join(dir, "client"),
+	}
+	builds := []struct{ out, src string }{
+		{p.aserver, "auth-server.go"},
+		{p.fserver, "fortune-server.go"},
+		{p.client, "../p1/client.go"},
+	}
+	for _, b := range builds {
+		out, err := exec.Command("go", "build", "-o", b.out, b.src).CombinedOutput()
+		if err != nil {
+			t.Fatalf("building %s: %s\n%s", b.src, err, out)
+		}
+	}
+	return p
+}
+
+// A loopback address free for both UDP and TCP, as the servers take clients
+// on both at the same address
+func freeAddr(t *testing.T) string {
+	for i := 0; i < 100; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := ln.Addr().String()
+		conn, err := net.ListenPacket("udp", addr)
+		ln.Close()
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+	}
+	t.Fatal("no free address")
+	return ""
+}
+
+// Output of a process, read while it is being written
+type output struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (o *output) Write(b []byte) (int, error) {
+	o.Lock()
+	defer o.Unlock()
+	return o.buf.Write(b)
+}
+
+func (o *output) String() string {
+	o.Lock()
+	defer o.Unlock()
+	return o.buf.String()
+}
+
+// A server process, killed at the end of the test
+type server struct {
+	name string
+	cmd  *exec.Cmd
+	out  *output
+	done chan struct{} // closed once it has exited
+	err  error
+}
+
+func startServer(t *testing.T, path string, args ...string) *server {
+	s := &server{
+		name: filepath.Base(path),
+		cmd:  exec.Command(path, args...),
+		out:  &output{},
+		done: make(chan struct{}),
+	}
+	s.cmd.Stdout, s.cmd.Stderr = s.out, s.out
+	if err := s.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		s.err = s.cmd.Wait()
+		close(s.done)
+	}()
+	t.Cleanup(func() {
+		s.cmd.Process.Kill()
+		<-s.done
+		if t.Failed() {
+			t.Logf("%s output:\n%s", s.name, s.out)
+		}
+	})
+	return s
+}
+
+// Wait for the server to exit, returning its exit error
+func (s *server) wait(t *testing.T, timeout time.Duration) error {
+	t.Helper()
+	select {
+	case <-s.done:
+		return s.err
+	case <-time.After(timeout):
+		t.Fatalf("%s still running after %s", s.name, timeout)
+		return nil
+	}
+}
+
+// Wait until a TCP listener is up at addr
+func waitListening(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("nothing listening at %s", addr)
+}
+
+// Servers at fresh addresses taking clients on UDP and TCP, the fserver
+// serving the given fortune file and the aserver the secret 42
+type testServers struct {
+	aserverAddr, rpcAddr, fserverAddr string
+	aserver, fserver                  *server
+}
+
+func startServers(t *testing.T, p programs, fortuneFile string, aserverFlags ...string) testServers {
+	s := testServers{aserverAddr: freeAddr(t), rpcAddr: freeAddr(t), fserverAddr: freeAddr(t)}
+	s.fserver = startServer(t, p.fserver, "-tcp", "-fortunes", fortuneFile, s.rpcAddr, s.fserverAddr)
+	waitListening(t, s.rpcAddr)
+	waitListening(t, s.fserverAddr)
+
+	args := append([]string{"-tcp"}, aserverFlags...)
+	args = append(args, s.aserverAddr, s.rpcAddr, "42")
+	s.aserver = startServer(t, p.aserver, args...)
+	waitListening(t, s.aserverAddr)
+	return s
+}
+
+// A fortune too long for a datagram comes whole over TCP
+func TestTCPFortune(t *testing.T) {
+	p := buildPrograms(t)
+	fortune := strings.TrimSpace(strings.Repeat("all work and no play ", 300))
+	fortuneFile := filepath.Join(t.TempDir(), "fortunes")
+	if err := os.WriteFile(fortuneFile, []byte(fortune+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := startServers(t, p, fortuneFile)
+
+	for _, args := range [][]string{{}, {"-encrypt"}} {
+		args = append(args, "-transport", "tcp", freeAddr(t), s.aserverAddr, "42")
+		out, err := exec.Command(p.client, args...).Output()
+		if err != nil {
+			t.Fatalf("client %v: %s", args, err)
+		}
+		if got := strings.TrimSuffix(string(out), "\n"); got != fortune {
+			t.Fatalf("client %v got %d bytes, want the %d byte fortune", args, len(got), len(fortune))
+		}
+	}
+}
+
+// Wait until the server has logged text
+func (s *server) waitOutput(t *testing.T, text string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if strings.Contains(s.out.String(), text) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("%s never logged %q", s.name, text)
+}
+
+// Whether the server is still running
+func (s *server) running() bool {
+	select {
+	case <-s.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// The envelope the servers speak, as seen from a client
+type wireEnvelope struct {
+	Type      string
+	Version   int
+	RequestID uint64
+	Payload   json.RawMessage
+}
+
+// A client the test runs one request at a time over UDP, so a handshake can
+// be left half done. It keeps one address for both servers, as the fserver
+// knows clients by the address the aserver saw.
+type stepClient struct {
+	t    *testing.T
+	conn *net.UDPConn
+	id   uint64
+}
+
+func newStepClient(t *testing.T) *stepClient {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &stepClient{t: t, conn: conn}
+}
+
+// Send msg in an envelope to the server at addr, returning the reply type
+// and decoding its payload into reply
+func (c *stepClient) send(addr string, msgType string, msg interface{}, reply interface{}) string {
+	c.t.Helper()
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	payload, _ := json.Marshal(msg)
+	c.id++
+	data, _ := json.Marshal(wireEnvelope{Type: msgType, Version: 1, RequestID: c.id, Payload: payload})
+	if _, err := c.conn.WriteToUDP(data, raddr); err != nil {
+		c.t.Fatal(err)
+	}
+
+	buf := make([]byte, 64<<10)
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		c.t.Fatalf("no %s reply from %s: %s", msgType, addr, err)
+	}
+	var env wireEnvelope
+	if err := json.Unmarshal(buf[:n], &env); err != nil {
+		c.t.Fatalf("reply from %s: %s", addr, err)
+	}
+	json.Unmarshal(env.Payload, reply)
+	return env.Type
+}
+
+// Send msg and fail the test unless the reply is of type replyType
+func (c *stepClient) expect(addr string, msgType string, msg interface{}, replyType string, reply interface{}) {
+	c.t.Helper()
+	var raw json.RawMessage
+	if got := c.send(addr, msgType, msg, &raw); got != replyType {
+		c.t.Fatalf("%s to %s got %s reply %s, want %s", msgType, addr, got, raw, replyType)
+	}
+	json.Unmarshal(raw, reply)
+}
+
+// The version 2 hash of a nonce
+func nonceHMAC(nonce int64, secret int64) string {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(secret))
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(nonce))
+	h := hmac.New(sha256.New, key)
+	h.Write(msg)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type stepNonce struct {
+	Nonce   int64
+	Version int
+}
+
+type stepFortuneInfo struct {
+	FortuneServer string
+	FortuneNonce  int64
+}
+
+type stepFortune struct {
+	Fortune string
+}
+
+// Get a nonce from the aserver
+func (c *stepClient) nonce(aserver string) stepNonce {
+	var nonce stepNonce
+	c.expect(aserver, "nonce-req", map[string]int{"Version": 2}, "nonce", &nonce)
+	return nonce
+}
+
+// Answer the aserver's nonce, getting fortune info
+func (c *stepClient) hash(aserver string, nonce stepNonce) stepFortuneInfo {
+	var fInfo stepFortuneInfo
+	hash := map[string]interface{}{"Hash": nonceHMAC(nonce.Nonce, 42), "Version": 2}
+	c.expect(aserver, "hash", hash, "fortune-info", &fInfo)
+	return fInfo
+}
+
+// Get the fortune the fortune info is good for
+func (c *stepClient) fortune(fInfo stepFortuneInfo) string {
+	var fortune stepFortune
+	req := map[string]int64{"FortuneNonce": fInfo.FortuneNonce}
+	c.expect(fInfo.FortuneServer, "fortune-req", req, "fortune", &fortune)
+	return fortune.Fortune
+}
+
+// On SIGTERM each server turns new clients away but lets handshakes under
+// way finish, then exits with a summary; clients caught by it fail cleanly
+func TestShutdownDrains(t *testing.T) {
+	p := buildPrograms(t)
+	fortuneFile := filepath.Join(t.TempDir(), "fortunes")
+	if err := os.WriteFile(fortuneFile, []byte("drained\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := startServers(t, p, fortuneFile, "-health-interval", "100ms")
+
+	// one client holds a nonce from the aserver, the other fortune info
+	first, second := newStepClient(t), newStepClient(t)
+	firstNonce := first.nonce(s.aserverAddr)
+	secondInfo := second.hash(s.aserverAddr, second.nonce(s.aserverAddr))
+
+	// with client processes coming and going
+	var load []*exec.Cmd
+	for i := 0; i < 8; i++ {
+		cmd := exec.Command(p.client, "-timeout", "100ms", "-attempts", "3", freeAddr(t), s.aserverAddr, "42")
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		load = append(load, cmd)
+	}
+
+	s.aserver.cmd.Process.Signal(syscall.SIGTERM)
+	s.aserver.waitOutput(t, "shutting down")
+	var errMessage struct{ Error string }
+	newStepClient(t).expect(s.aserverAddr, "nonce-req", map[string]int{"Version": 2}, "error", &errMessage)
+	if errMessage.Error != "server shutting down" {
+		t.Fatalf("new client got %q while the aserver drains", errMessage.Error)
+	}
+	if !s.aserver.running() {
+		t.Fatal("aserver exited with a nonce outstanding")
+	}
+	firstInfo := first.hash(s.aserverAddr, firstNonce)
+	if err := s.aserver.wait(t, 5*time.Second); err != nil {
+		t.Fatalf("aserver: %s", err)
+	}
+	s.aserver.waitOutput(t, "aserver stopped, drained")
+
+	s.fserver.cmd.Process.Signal(syscall.SIGTERM)
+	s.fserver.waitOutput(t, "shutting down")
+	for _, step := range []struct {
+		c     *stepClient
+		fInfo stepFortuneInfo
+	}{{first, firstInfo}, {second, secondInfo}} {
+		if !s.fserver.running() {
+			t.Fatal("fserver exited with a fortune nonce unused")
+		}
+		if fortune := step.c.fortune(step.fInfo); fortune != "drained" {
+			t.Fatalf("got fortune %q", fortune)
+		}
+	}
+	if err := s.fserver.wait(t, 5*time.Second); err != nil {
+		t.Fatalf("fserver: %s", err)
+	}
+	s.fserver.waitOutput(t, "fserver stopped, drained")
+
+	// a fortune, a server gone or shutting down, or no fserver left
+	for _, cmd := range load {
+		err := cmd.Wait()
+		var exit *exec.ExitError
+		if err != nil && (!errors.As(err, &exit) || (exit.ExitCode() != 2 && exit.ExitCode() != 5)) {
+			t.Errorf("load client: %s", err)
+		}
+	}
+}
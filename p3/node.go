@@ -3,10 +3,22 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
 	"net/rpc"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -36,10 +48,35 @@ type ValReply struct {
 type KeyValService int
 
 type PingBit struct {
+	value   string
+	changed time.Time // when value was last seen to change
+}
+
+// a key the leader has seen holding a reclaimable value
+type tombstone struct {
 	value string
+	since time.Time
+}
+
+// values written by the slot allocator
+const (
+	freeVal        = "free"      // reclaimed key, may be assigned again
+	movedPrefix    = "moved:"    // moved:<key>, the node must move to <key>
+	reservedPrefix = "reserved:" // reserved:<id>, held for a moving node
+)
+
+// Membership as reported by -output json and the -http endpoint.
+type MembershipView struct {
+	Timestamp time.Time `json:"timestamp"`
+	Leader    string    `json:"leader"`
+	Members   []string  `json:"members"` // leader first
+	Key       string    `json:"key"`     // this node's kvService key
+	Joined    []string  `json:"joined"`  // members new since the last report
+	Left      []string  `json:"left"`    // members gone since the last report
 }
 
 var idsPing map[string]*PingBit
+var tombstones = make(map[string]*tombstone)
 var node_keys []string
 var myKey string
 var myID string
@@ -48,82 +85,259 @@ var client *rpc.Client
 var myIdPingGlobal string
 var leader bool
 
-// function to constantly ping server, flipping between 1 and 0
+// configuration from command-line flags
+var kvAddr string
+var heartbeatInterval time.Duration
+var scanInterval time.Duration
+var failTimeout time.Duration
+var outputFormat string
+var kvRetries int
+var kvBackoff time.Duration
+var reclaimAfter time.Duration
+var compact bool
+var httpAddr string
+
+// last reported membership, read by the -http endpoint
+var currentView = struct {
+	sync.Mutex
+	view MembershipView
+}{view: MembershipView{Members: []string{}, Joined: []string{}, Left: []string{}}}
+
+// call kvService, redialing and retrying with exponential backoff on failure
+func kvCall(method string, args interface{}, reply *ValReply) error {
+	backoff := kvBackoff
+	err := client.Call(method, args, reply)
+	for attempt := 0; err != nil && attempt < kvRetries; attempt++ {
+		fmt.Fprintf(os.Stderr, "kvService %s failed (%s), retrying in %s\n", method, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+
+		// the connection is gone, dial a new one
+		if !isServerError(err) {
+			client.Close()
+			kvService, dialErr := rpc.Dial("tcp", kvAddr)
+			if dialErr != nil {
+				err = dialErr
+				continue
+			}
+			client = kvService
+		}
+		err = client.Call(method, args, reply)
+	}
+	return err
+}
+
+// errors returned by the service itself rather than the transport
+func isServerError(err error) bool {
+	var serverErr rpc.ServerError
+	return errors.As(err, &serverErr)
+}
+
+// function to constantly ping server, cycling the ping bit through 0 - 9
 func pingServer() {
 	var kvVal ValReply
 
-	// flip between 1 and 0, inactive node if same bit comes twice
-	pingBit = 1 - pingBit
+	// a digit rather than 0/1 so scans slower than the heartbeat still see it move
+	pingBit = (pingBit + 1) % 10
 
 	pingStr := strconv.Itoa(pingBit)
 
-	// Put("myKey", myID-ping-bit)
+	// TestSet("myKey", last-ping, myID-ping-bit), so a node that was declared
+	// dead never overwrites a key that has since been reclaimed
 	myIdPing := myID + pingStr
+	lastIdPing := myIdPingGlobal
 	myIdPingGlobal = myIdPing
 
-	putArgs := PutArgs{
-		Key: myKey,
-		Val: myIdPing}
-	err := client.Call("KeyValService.Put", putArgs, &kvVal)
+	tsArgs := TestSetArgs{
+		Key:     myKey,
+		TestVal: lastIdPing,
+		NewVal:  myIdPing,
+	}
+	err := kvCall("KeyValService.TestSet", tsArgs, &kvVal)
 	checkError(err)
+
+	// our key was reclaimed, compacted or became unavailable
+	if kvVal.Val != myIdPing && !adoptMovedKey(kvVal.Val) {
+		assignKey()
+	}
 }
 
-// function to assign key to node
+// test-set a key, returning the value it holds afterwards
+func testSet(key, testVal, newVal string) string {
+	var kvVal ValReply
+	tsArgs := TestSetArgs{
+		Key:     key,
+		TestVal: testVal,
+		NewVal:  newVal,
+	}
+	err := kvCall("KeyValService.TestSet", tsArgs, &kvVal)
+	checkError(err)
+	return kvVal.Val
+}
+
+// function to assign key to node, taking the first never used or reclaimed key
+// and freeing the key it held, if that still holds its last ping
 func assignKey() {
 	key := 0
+	oldKey, oldIdPing := myKey, myIdPingGlobal
 
 	pingStr := strconv.Itoa(pingBit)
 	myIdPing := myID + pingStr
 	myIdPingGlobal = myIdPing
 
 	for {
-		var kvVal ValReply
 		myKey := strconv.Itoa(key)
-		tsArgs := TestSetArgs{
-			Key:     myKey,
-			TestVal: "",
-			NewVal:  myIdPingGlobal,
+		val := testSet(myKey, "", myIdPing)
+		if val == freeVal {
+			val = testSet(myKey, freeVal, myIdPing)
+			if val == "" {
+				// the leader truncated this key meanwhile, try it again
+				continue
+			}
 		}
-		err := client.Call("KeyValService.TestSet", tsArgs, &kvVal)
-		checkError(err)
-		if kvVal.Val == myIdPing {
+		if val == myIdPing {
 			break
 		}
 		key++
 	}
 	myKey = strconv.Itoa(key)
+
+	// a stale id left on the old key would share our ping entry and keep
+	// both keys alive
+	if oldKey != "" && oldKey != myKey {
+		testSet(oldKey, oldIdPing, freeVal)
+	}
+}
+
+// move to the key the leader reserved for us during compaction
+func adoptMovedKey(val string) bool {
+	if !strings.HasPrefix(val, movedPrefix) {
+		return false
+	}
+	newKey := val[len(movedPrefix):]
+	if testSet(newKey, reservedPrefix+myID, myIdPingGlobal) != myIdPingGlobal {
+		return false
+	}
+
+	// release the old key for reuse
+	testSet(myKey, val, freeVal)
+	myKey = newKey
+	return true
 }
 
-// keep track of the living nodes in kvService
+// keep track of the living nodes in kvService, a node is dead once its
+// ping bit has not changed for failTimeout
 func isAlive(id, idBit string) bool {
 	val := idsPing[id]
 
 	// assigning new node id to bit
 	if val == nil || val.value != idBit {
 		val = &PingBit{
-			value: idBit,
+			value:   idBit,
+			changed: time.Now(),
 		}
 		idsPing[id] = val
 		return true
 	}
 
-	return false
+	return time.Since(val.changed) < failTimeout
 }
 
-// flag to indicate dead key in kvService
-func setKeyToDeadNode(key string) {
-	var kvVal ValReply
+// values that mark a key as not held by any node
+func isNodeValue(val string) bool {
+	return val != "unavailable" && !isReclaimable(val) && val != freeVal
+}
 
-	putArgs := PutArgs{
-		Key: key,
-		Val: "dead"}
-	err := client.Call("KeyValService.Put", putArgs, &kvVal)
-	checkError(err)
+// values the leader may turn into free keys once they have settled
+func isReclaimable(val string) bool {
+	return val == "dead" || val == "left" ||
+		strings.HasPrefix(val, movedPrefix) || strings.HasPrefix(val, reservedPrefix)
+}
+
+// flag to indicate dead key in kvService, unless the node heartbeated meanwhile
+func setKeyToDeadNode(key, val string) {
+	testSet(key, val, "dead")
+}
+
+// free keys that have held a tombstone for reclaimAfter, then truncate trailing
+// free keys so scans stop earlier; vals holds the scanned value of each key
+func reclaimKeys(vals []string) {
+	for k, val := range vals {
+		key := strconv.Itoa(k)
+		if !isReclaimable(val) {
+			delete(tombstones, key)
+			continue
+		}
+
+		// a recovering node cannot race us: its heartbeat test-sets against its
+		// own last value and fails once the key holds anything else
+		t, ok := tombstones[key]
+		if !ok || t.value != val {
+			tombstones[key] = &tombstone{value: val, since: time.Now()}
+		} else if time.Since(t.since) >= reclaimAfter {
+			if testSet(key, val, freeVal) == freeVal {
+				vals[k] = freeVal
+			}
+			delete(tombstones, key)
+		}
+	}
+
+	// truncate from the end, so no empty key ever hides a later one; a node
+	// may have taken the next key since the scan, while this one still held
+	// its tombstone
+	for k := len(vals) - 1; k >= 0 && vals[k] == freeVal; k-- {
+		var kvVal ValReply
+		err := kvCall("KeyValService.Get", GetArgs{strconv.Itoa(k + 1)}, &kvVal)
+		checkError(err)
+		if kvVal.Val != "" || testSet(strconv.Itoa(k), freeVal, "") != "" {
+			break
+		}
+	}
+}
+
+// move the node on the highest key to the lowest free key; the node adopts the
+// reserved key on its next heartbeat and frees its old one
+func compactKeys(vals []string) {
+	free := -1
+	for k, val := range vals {
+		if val == freeVal {
+			free = k
+			break
+		}
+	}
+	if free < 0 {
+		return
+	}
+
+	for k := len(vals) - 1; k > free; k-- {
+		if !isNodeValue(vals[k]) {
+			continue
+		}
+		id := vals[k][:len(vals[k])-1]
+		freeKey := strconv.Itoa(free)
+		reserved := reservedPrefix + id
+		if testSet(freeKey, freeVal, reserved) != reserved {
+			return
+		}
+
+		// re-read the node's value, it heartbeats independently of our scan
+		var kvVal ValReply
+		err := kvCall("KeyValService.Get", GetArgs{strconv.Itoa(k)}, &kvVal)
+		checkError(err)
+
+		moved := movedPrefix + freeKey
+		if !isNodeValue(kvVal.Val) || kvVal.Val[:len(kvVal.Val)-1] != id ||
+			testSet(strconv.Itoa(k), kvVal.Val, moved) != moved {
+			testSet(freeKey, reserved, freeVal)
+		}
+		return
+	}
 }
 
 // simple algorithm to check if node is at the head of list
 func leaderAlgorithm(ids []string) {
-	if ids[0] == myID {
+	// ids still carry their ping bit
+	if ids[0][:len(ids[0])-1] == myID {
 		leader = true
 	} else {
 		leader = false
@@ -134,57 +348,163 @@ func leaderAlgorithm(ids []string) {
 func printIDs(ids []string) {
 	leaderAlgorithm(ids)
 
+	names := []string{}
 	for _, id := range ids {
 		_id := id[:len(id)-1]
-		fmt.Print(_id)
-		fmt.Print(" ")
+		names = append(names, _id)
 	}
-	fmt.Println()
+	reportIDs(names)
+}
+
+// output the membership in the configured format and publish it for -http
+func reportIDs(ids []string) {
+	view := MembershipView{
+		Timestamp: time.Now(),
+		Members:   ids,
+		Key:       myKey,
+		Joined:    []string{},
+		Left:      []string{},
+	}
+	if len(ids) > 0 {
+		view.Leader = ids[0]
+	}
+
+	current := make(map[string]bool)
+	for _, id := range ids {
+		current[id] = true
+	}
+
+	currentView.Lock()
+	previous := make(map[string]bool)
+	for _, id := range currentView.view.Members {
+		previous[id] = true
+		if !current[id] {
+			view.Left = append(view.Left, id)
+		}
+	}
+	for _, id := range ids {
+		if !previous[id] {
+			view.Joined = append(view.Joined, id)
+		}
+	}
+	currentView.view = view
+	currentView.Unlock()
+
+	switch outputFormat {
+	case "text":
+		for _, id := range ids {
+			fmt.Print(id)
+			fmt.Print(" ")
+		}
+		fmt.Println()
+	case "json":
+		line, err := json.Marshal(view)
+		checkError(err)
+		fmt.Println(string(line))
+	}
+}
+
+// serve the last reported membership as JSON
+func serveView(w http.ResponseWriter, r *http.Request) {
+	currentView.Lock()
+	view := currentView.view
+	currentView.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(view)
+}
+
+func startHTTP() {
+	ln, err := net.Listen("tcp", httpAddr)
+	checkError(err)
+
+	http.HandleFunc("/", serveView)
+	go func() {
+		checkError(http.Serve(ln, nil))
+	}()
 }
 
 // get the IDs of available nodes
 func getIDs() {
 	key := 0
 	ids := []string{}
+	vals := []string{}
+	seen := make(map[string]bool)
 
 	// loop through keys 0 - N
 	for {
 		var kvVal ValReply
 		keyS := strconv.Itoa(key)
 		getArgs := GetArgs{keyS}
-		err := client.Call("KeyValService.Get", getArgs, &kvVal)
+		err := kvCall("KeyValService.Get", getArgs, &kvVal)
 		checkError(err)
 
 		if kvVal.Val == "" {
 			break
 		}
+		vals = append(vals, kvVal.Val)
 
 		n := len(kvVal.Val)
 
+		// a node being moved here by compaction keeps its membership under
+		// the new key, so the move is not seen as it leaving and joining
+		if strings.HasPrefix(kvVal.Val, reservedPrefix) {
+			id := kvVal.Val[len(reservedPrefix):]
+			if p := idsPing[id]; p != nil && !seen[id] && time.Since(p.changed) < failTimeout {
+				seen[id] = true
+				ids = append(ids, id+p.value)
+			}
+		}
+
 		// only adding keys that are available
-		if kvVal.Val != "unavailable" && kvVal.Val != "dead" {
+		if isNodeValue(kvVal.Val) {
 			id := kvVal.Val[:n-1]
+			// listed already if its new key was reserved before its old
+			// key was marked moved
+			moving := seen[id]
+			seen[id] = true
 			//fmt.Println(id)
 			idBit := kvVal.Val[n-1:]
 			// checking for node's heartbeat (1/1 or 0/0 = dead, 0/1 = alive)
 			if isAlive(id, idBit) {
-				ids = append(ids, kvVal.Val)
+				if !moving {
+					ids = append(ids, kvVal.Val)
+				}
 			} else {
 				// set node key to dead when node fails, only leader does this
 				if leader {
-					setKeyToDeadNode(keyS)
+					setKeyToDeadNode(keyS, kvVal.Val)
 				}
 			}
 		}
 		key++
 	}
+
+	// forget nodes that left or lost their key, so a restart is not judged
+	// against a stale ping bit
+	for id := range idsPing {
+		if !seen[id] {
+			delete(idsPing, id)
+		}
+	}
+
 	// Print keys from kvService, but first check if my key became unavailable
 	if reAssignKeyCheck(ids) {
 		printIDs(ids)
-	} else {
+	} else if k, _ := strconv.Atoi(myKey); k >= len(vals) || !adoptMovedKey(vals[k]) {
 		// if unvailable, don't print, but assign new key to self
 		assignKey()
 	}
+
+	// only the leader reclaims and compacts keys
+	if !leader {
+		tombstones = make(map[string]*tombstone)
+		return
+	}
+	reclaimKeys(vals)
+	if compact {
+		compactKeys(vals)
+	}
 }
 
 // Check if myid is part of the available list
@@ -197,23 +517,553 @@ func reAssignKeyCheck(ids []string) bool {
 	return false
 }
 
-/*go run node.go [ip:port] [id]
+// SWIM-style gossip membership
+//////////////////////////////
+
+// gossip protocol parameters
+const (
+	gossipIndirectProbes = 3 // peers asked to probe on our behalf
+	gossipMaxPiggyback   = 8 // updates carried per message
+	gossipKeyPrefix      = "gossip-"
+)
+
+// member states
+const (
+	stateAlive   = "alive"
+	stateSuspect = "suspect"
+	stateDead    = "dead"
+	stateLeft    = "left"
+)
+
+// Membership update piggybacked on every gossip message.
+type MemberUpdate struct {
+	ID          string
+	Addr        string // gossip UDP ip:port of the member
+	Key         int    // kvService key, orders leadership
+	State       string // alive, suspect, dead or left
+	Incarnation int    // only the member itself bumps this
+}
+
+// Message exchanged between nodes over UDP.
+type GossipMessage struct {
+	Type    string // "ping", "ping-req" or "ack"
+	Seq     uint64
+	From    string // gossip address of the sender
+	Target  string // address to probe, ping-req only
+	Updates []MemberUpdate
+}
+
+// an update waiting to be disseminated
+type broadcast struct {
+	update    MemberUpdate
+	transmits int
+}
+
+// local view of a member
+type member struct {
+	MemberUpdate
+	suspectAt time.Time
+}
+
+// whether the member failed or left the group
+func (m *member) gone() bool {
+	return m.State == stateDead || m.State == stateLeft
+}
+
+var gossipAddr string
+var gossipConn *net.UDPConn
+
+// derived from the heartbeat interval (the protocol period) and failTimeout
+var gossipProbeTimeout time.Duration     // wait for a direct ack
+var gossipIndirectTimeout time.Duration  // wait for an indirect ack
+var gossipSuspicionTimeout time.Duration // suspect to dead
+
+// gossip membership, ack waiters and dissemination queue
+var gossip = struct {
+	sync.Mutex
+	members     map[string]*member
+	acks        map[uint64]chan bool
+	broadcasts  []*broadcast
+	probeOrder  []string
+	probeIndex  int
+	seq         uint64
+	incarnation int
+}{
+	members: make(map[string]*member),
+	acks:    make(map[uint64]chan bool),
+}
+
+// register our gossip address and learn peers through kvService
+func bootstrapGossip() {
+	var kvVal ValReply
+	key, _ := strconv.Atoi(myKey)
+
+	putArgs := PutArgs{
+		Key: gossipKeyPrefix + myID,
+		Val: gossipAddr}
+	err := kvCall("KeyValService.Put", putArgs, &kvVal)
+	checkError(err)
+
+	gossip.Lock()
+	// start above any incarnation a previous run of this node used
+	gossip.incarnation = int(time.Now().Unix())
+	self := MemberUpdate{ID: myID, Addr: gossipAddr, Key: key, State: stateAlive,
+		Incarnation: gossip.incarnation}
+	gossip.members[myID] = &member{MemberUpdate: self}
+	queueBroadcast(self)
+	gossip.Unlock()
+
+	// scan keys 0 - N for other nodes, as getIDs does
+	for k := 0; ; k++ {
+		var kvVal ValReply
+		getArgs := GetArgs{strconv.Itoa(k)}
+		err := kvCall("KeyValService.Get", getArgs, &kvVal)
+		checkError(err)
+
+		if kvVal.Val == "" {
+			break
+		}
+		if !isNodeValue(kvVal.Val) {
+			continue
+		}
+
+		id := kvVal.Val[:len(kvVal.Val)-1]
+		if id == myID {
+			continue
+		}
+
+		var addrVal ValReply
+		getArgs = GetArgs{gossipKeyPrefix + id}
+		err = kvCall("KeyValService.Get", getArgs, &addrVal)
+		checkError(err)
+		if addrVal.Val == "" || addrVal.Val == "unavailable" {
+			continue
+		}
+
+		gossip.Lock()
+		if _, ok := gossip.members[id]; !ok {
+			gossip.members[id] = &member{MemberUpdate: MemberUpdate{
+				ID: id, Addr: addrVal.Val, Key: k, State: stateAlive}}
+		}
+		gossip.Unlock()
+	}
+}
+
+// listen for gossip messages from other nodes
+func startGossip() {
+	udpAddr, err := net.ResolveUDPAddr("udp", gossipAddr)
+	checkError(err)
+
+	gossipConn, err = net.ListenUDP("udp", udpAddr)
+	checkError(err)
+
+	bootstrapGossip()
+
+	go func() {
+		for {
+			buf := make([]byte, 65536)
+			n, _, err := gossipConn.ReadFromUDP(buf)
+			checkError(err)
+
+			var msg GossipMessage
+			if json.Unmarshal(buf[:n], &msg) != nil {
+				continue
+			}
+			go handleGossipMessage(msg)
+		}
+	}()
+}
+
+// send a gossip message with piggybacked updates
+func sendGossip(addr string, msg GossipMessage) {
+	gossip.Lock()
+	msg.From = gossipAddr
+	msg.Updates = takeBroadcasts()
+	gossip.Unlock()
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return
+	}
+	buf, err := json.Marshal(msg)
+	checkError(err)
+
+	// a lost datagram is indistinguishable from a failed peer
+	gossipConn.WriteToUDP(buf, udpAddr)
+}
+
+func handleGossipMessage(msg GossipMessage) {
+	gossip.Lock()
+	for _, u := range msg.Updates {
+		applyUpdate(u)
+	}
+	gossip.Unlock()
+
+	switch msg.Type {
+	case "ping":
+		sendGossip(msg.From, GossipMessage{Type: "ack", Seq: msg.Seq})
+
+	case "ping-req":
+		// probe the target and relay its ack back to the requester
+		seq, ack := newAckWaiter()
+		sendGossip(msg.Target, GossipMessage{Type: "ping", Seq: seq})
+		if waitAck(seq, ack, gossipProbeTimeout) {
+			sendGossip(msg.From, GossipMessage{Type: "ack", Seq: msg.Seq})
+		}
+
+	case "ack":
+		gossip.Lock()
+		if ack, ok := gossip.acks[msg.Seq]; ok {
+			ack <- true
+			delete(gossip.acks, msg.Seq)
+		}
+		gossip.Unlock()
+	}
+}
+
+func newAckWaiter() (uint64, chan bool) {
+	gossip.Lock()
+	defer gossip.Unlock()
+	gossip.seq++
+	ack := make(chan bool, 1)
+	gossip.acks[gossip.seq] = ack
+	return gossip.seq, ack
+}
+
+// wait for an ack, dropping the waiter on timeout
+func waitAck(seq uint64, ack chan bool, timeout time.Duration) bool {
+	select {
+	case <-ack:
+		return true
+	case <-time.After(timeout):
+		gossip.Lock()
+		delete(gossip.acks, seq)
+		gossip.Unlock()
+		return false
+	}
+}
+
+// apply an update using SWIM precedence rules, gossip must be locked
+func applyUpdate(u MemberUpdate) {
+	if u.ID == myID {
+		// refute any suspicion about ourselves with a newer incarnation
+		if u.State != stateAlive && u.Incarnation >= gossip.incarnation {
+			gossip.incarnation = u.Incarnation + 1
+			self := gossip.members[myID]
+			self.Incarnation = gossip.incarnation
+			queueBroadcast(self.MemberUpdate)
+		}
+		return
+	}
+
+	m, ok := gossip.members[u.ID]
+	if !ok {
+		if u.State == stateDead || u.State == stateLeft {
+			return
+		}
+		m = &member{MemberUpdate: u}
+		if u.State == stateSuspect {
+			m.suspectAt = time.Now()
+		}
+		gossip.members[u.ID] = m
+		queueBroadcast(u)
+		return
+	}
+
+	override := false
+	switch u.State {
+	case stateAlive:
+		// a restarted member rejoins with a newer incarnation
+		override = u.Incarnation > m.Incarnation
+	case stateSuspect:
+		override = (m.State == stateAlive && u.Incarnation >= m.Incarnation) ||
+			(m.State == stateSuspect && u.Incarnation > m.Incarnation)
+	case stateDead, stateLeft:
+		override = !m.gone()
+	}
+	if !override {
+		return
+	}
+
+	if u.State == stateSuspect && m.State != stateSuspect {
+		m.suspectAt = time.Now()
+	}
+	m.MemberUpdate = u
+	queueBroadcast(u)
+}
+
+// queue an update for dissemination, replacing older news about the member
+func queueBroadcast(u MemberUpdate) {
+	for i, b := range gossip.broadcasts {
+		if b.update.ID == u.ID {
+			gossip.broadcasts = append(gossip.broadcasts[:i], gossip.broadcasts[i+1:]...)
+			break
+		}
+	}
+	gossip.broadcasts = append(gossip.broadcasts, &broadcast{update: u})
+}
+
+// pick the least transmitted updates, gossip must be locked
+func takeBroadcasts() []MemberUpdate {
+	limit := 3 * int(math.Ceil(math.Log2(float64(len(gossip.members)+1))))
+
+	sort.SliceStable(gossip.broadcasts, func(i, j int) bool {
+		return gossip.broadcasts[i].transmits < gossip.broadcasts[j].transmits
+	})
+
+	updates := []MemberUpdate{}
+	kept := gossip.broadcasts[:0]
+	for _, b := range gossip.broadcasts {
+		if len(updates) < gossipMaxPiggyback {
+			updates = append(updates, b.update)
+			b.transmits++
+		}
+		if b.transmits < limit {
+			kept = append(kept, b)
+		}
+	}
+	gossip.broadcasts = kept
+	return updates
+}
+
+// next probe target in a shuffled round-robin over live members
+func nextProbeTarget() *member {
+	gossip.Lock()
+	defer gossip.Unlock()
+
+	for tries := 0; tries < 2; tries++ {
+		for gossip.probeIndex < len(gossip.probeOrder) {
+			id := gossip.probeOrder[gossip.probeIndex]
+			gossip.probeIndex++
+			if m, ok := gossip.members[id]; ok && !m.gone() {
+				target := *m
+				return &target
+			}
+		}
+
+		// start a new round
+		gossip.probeOrder = gossip.probeOrder[:0]
+		for id, m := range gossip.members {
+			if id != myID && !m.gone() {
+				gossip.probeOrder = append(gossip.probeOrder, id)
+			}
+		}
+		rand.Shuffle(len(gossip.probeOrder), func(i, j int) {
+			gossip.probeOrder[i], gossip.probeOrder[j] = gossip.probeOrder[j], gossip.probeOrder[i]
+		})
+		gossip.probeIndex = 0
+	}
+	return nil
+}
+
+// random live members other than ourselves and the target
+func indirectProbers(target string) []string {
+	gossip.Lock()
+	defer gossip.Unlock()
+
+	addrs := []string{}
+	for id, m := range gossip.members {
+		if id != myID && id != target && m.State == stateAlive {
+			addrs = append(addrs, m.Addr)
+		}
+	}
+	rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	if len(addrs) > gossipIndirectProbes {
+		addrs = addrs[:gossipIndirectProbes]
+	}
+	return addrs
+}
+
+// one SWIM protocol period: direct probe, indirect probes, then suspicion
+func gossipProbe() {
+	if target := nextProbeTarget(); target != nil {
+		seq, ack := newAckWaiter()
+		sendGossip(target.Addr, GossipMessage{Type: "ping", Seq: seq})
+		acked := waitAck(seq, ack, gossipProbeTimeout)
+
+		if !acked {
+			seq, ack = newAckWaiter()
+			for _, addr := range indirectProbers(target.ID) {
+				sendGossip(addr, GossipMessage{Type: "ping-req", Seq: seq, Target: target.Addr})
+			}
+			acked = waitAck(seq, ack, gossipIndirectTimeout)
+		}
+
+		if !acked {
+			gossip.Lock()
+			u := target.MemberUpdate
+			u.State = stateSuspect
+			applyUpdate(u)
+			gossip.Unlock()
+		}
+	}
+
+	// suspects that were not refuted in time are declared dead
+	gossip.Lock()
+	for _, m := range gossip.members {
+		if m.State == stateSuspect && time.Since(m.suspectAt) > gossipSuspicionTimeout {
+			u := m.MemberUpdate
+			u.State = stateDead
+			applyUpdate(u)
+		}
+	}
+	gossip.Unlock()
+}
+
+// print live gossip members where leader (lowest key) is first in list
+func printGossipIDs() {
+	gossip.Lock()
+	members := []MemberUpdate{}
+	for _, m := range gossip.members {
+		if !m.gone() {
+			members = append(members, m.MemberUpdate)
+		}
+	}
+	gossip.Unlock()
+
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Key != members[j].Key {
+			return members[i].Key < members[j].Key
+		}
+		return members[i].ID < members[j].ID
+	})
+
+	leader = len(members) > 0 && members[0].ID == myID
+
+	ids := []string{}
+	for _, m := range members {
+		ids = append(ids, m.ID)
+	}
+	reportIDs(ids)
+}
+
+// tell peers we are leaving, waiting briefly for the news to be acked
+func leaveGossip() {
+	gossip.Lock()
+	self := gossip.members[myID]
+	self.State = stateLeft
+	queueBroadcast(self.MemberUpdate)
+
+	peers := []string{}
+	for id, m := range gossip.members {
+		if id != myID && !m.gone() {
+			peers = append(peers, m.Addr)
+		}
+	}
+	gossip.Unlock()
+
+	acks := []chan bool{}
+	seqs := []uint64{}
+	for _, addr := range peers {
+		seq, ack := newAckWaiter()
+		sendGossip(addr, GossipMessage{Type: "ping", Seq: seq})
+		seqs = append(seqs, seq)
+		acks = append(acks, ack)
+	}
+	for i := range acks {
+		waitAck(seqs[i], acks[i], gossipProbeTimeout)
+	}
+}
+
+// release our key so peers drop us on their next scan instead of waiting for
+// the failure timeout; if we were leader the node on the next key takes over
+func leave() {
+	var kvVal ValReply
+	wasLeader := leader
+
+	if gossipAddr != "" {
+		leaveGossip()
+	}
+
+	// only release the key if it still holds our id
+	tsArgs := TestSetArgs{
+		Key:     myKey,
+		TestVal: myIdPingGlobal,
+		NewVal:  "left",
+	}
+	err := kvCall("KeyValService.TestSet", tsArgs, &kvVal)
+	checkError(err)
+
+	if wasLeader {
+		fmt.Fprintf(os.Stderr, "%s left, handing off leadership\n", myID)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s left\n", myID)
+	}
+}
+
+/*go run node.go [flags] [ip:port] [id]
 [ip:port] : address of the key-value service
-[id] : a unique string identifier for the node (no spaces)*/
+[id] : a unique string identifier for the node (no spaces)
+Run with -h for the list of flags.*/
 
 // Main server loop.
 func main() {
 	// parse args
-	usage := fmt.Sprintf("Usage: %s ip:port id\n", os.Args[0])
-	if len(os.Args) != 3 {
-		fmt.Printf(usage)
+	flag.StringVar(&gossipAddr, "gossip", "",
+		"UDP ip:port for SWIM gossip; kvService is then only used for bootstrap")
+	flag.DurationVar(&heartbeatInterval, "heartbeat", 5000*time.Millisecond,
+		"interval between heartbeats (gossip protocol period)")
+	flag.DurationVar(&scanInterval, "scan", 5000*time.Millisecond,
+		"interval between membership scans and output")
+	flag.DurationVar(&failTimeout, "fail-timeout", 0,
+		"time without a heartbeat before a node is dead (default 2*heartbeat + scan)")
+	flag.DurationVar(&reclaimAfter, "reclaim-after", 0,
+		"time a dead or left key must settle before reuse (default fail-timeout)")
+	flag.BoolVar(&compact, "compact", false,
+		"as leader, move nodes down into free keys to keep the key range dense")
+	flag.StringVar(&outputFormat, "output", "text",
+		"membership output format: text, json (one object per line) or none")
+	flag.StringVar(&httpAddr, "http", "",
+		"local ip:port serving the current membership as JSON")
+	flag.IntVar(&kvRetries, "kv-retries", 3, "retries for a failed kvService call")
+	flag.DurationVar(&kvBackoff, "kv-backoff", 500*time.Millisecond,
+		"delay before the first kvService retry, doubled on each retry")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] ip:port id\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if heartbeatInterval <= 0 || scanInterval <= 0 || kvRetries < 0 || kvBackoff < 0 {
+		fmt.Fprintln(os.Stderr, "intervals must be positive and retries non-negative")
+		os.Exit(1)
+	}
+	if outputFormat != "text" && outputFormat != "json" && outputFormat != "none" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", outputFormat)
 		os.Exit(1)
 	}
 
-	kvAddr := os.Args[1]
+	// a live node heartbeats at least once per interval, and may be observed
+	// just before and just after a scan
+	if failTimeout == 0 {
+		failTimeout = 2*heartbeatInterval + scanInterval
+	}
+	if failTimeout <= heartbeatInterval {
+		fmt.Fprintln(os.Stderr, "fail-timeout must be longer than the heartbeat interval")
+		os.Exit(1)
+	}
+
+	// the ping digit wraps every 10 heartbeats, so scans that far apart can
+	// see the same digit every time; one heartbeat is left for timer drift
+	if gossipAddr == "" && scanInterval >= 9*heartbeatInterval {
+		fmt.Fprintln(os.Stderr, "scan must be shorter than 9 heartbeat intervals")
+		os.Exit(1)
+	}
+	if reclaimAfter == 0 {
+		reclaimAfter = failTimeout
+	}
+	gossipProbeTimeout = heartbeatInterval / 5
+	gossipIndirectTimeout = 2 * heartbeatInterval / 5
+	gossipSuspicionTimeout = failTimeout
+
+	kvAddr = flag.Arg(0)
 
 	// Set as current value to associate with keys or nodes
-	id := os.Args[2]
+	id := flag.Arg(1)
 	myID = id
 
 	// Connect to the KV-service via RPC.
@@ -224,20 +1074,55 @@ func main() {
 	idsPing = make(map[string]*PingBit)
 	assignKey()
 
-	// timer for constant tick
-	t := time.NewTicker(5000 * time.Millisecond)
+	if httpAddr != "" {
+		startHTTP()
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	scan := time.NewTicker(scanInterval)
+
+	// leave gracefully on planned shutdowns
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	// gossip mode: membership comes from peers, not kvService scans
+	if gossipAddr != "" {
+		startGossip()
+		gossipProbe()
+		printGossipIDs()
+		for {
+			select {
+			case <-heartbeat.C:
+				gossipProbe()
+			case <-scan.C:
+				printGossipIDs()
+			case <-stop:
+				leave()
+				os.Exit(0)
+			}
+		}
+	}
+
+	// Get keys from kvService
+	getIDs()
+	pingServer()
 	for {
-		// Get keys from kvService
-		getIDs()
-		pingServer()
-		<-t.C
+		select {
+		case <-heartbeat.C:
+			pingServer()
+		case <-scan.C:
+			getIDs()
+		case <-stop:
+			leave()
+			os.Exit(0)
+		}
 	}
 }
 
 // If error is non-nil, print it out and halt.
 func checkError(err error) {
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error ", err.Error())
+		fmt.Fprintf(os.Stderr, "Error %s\n", err.Error())
 		os.Exit(1)
 	}
 }